@@ -1,6 +1,7 @@
 CREATE TABLE IF NOT EXISTS users (
-    id    BIGINT AUTO_INCREMENT PRIMARY KEY,
-    login VARCHAR(25)
+    id          BIGINT AUTO_INCREMENT PRIMARY KEY,
+    login       VARCHAR(25) NOT NULL UNIQUE,
+    password    CHAR(60) NOT NULL
 );
 --
 CREATE TABLE IF NOT EXISTS followers (
@@ -17,4 +18,14 @@ CREATE TABLE IF NOT EXISTS publications (
     txt         VARCHAR(512),
     createdAt   TIMESTAMP,
     FOREIGN KEY (author) REFERENCES users(id)
+);
+--
+CREATE TABLE IF NOT EXISTS outbox (
+    id              BIGINT AUTO_INCREMENT PRIMARY KEY,
+    publicationId   BIGINT,
+    payload         TEXT,
+    createdAt       TIMESTAMP,
+    sentAt          TIMESTAMP NULL,
+    INDEX (sentAt, id),
+    FOREIGN KEY (publicationId) REFERENCES publications(id)
 );
\ No newline at end of file
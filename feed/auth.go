@@ -0,0 +1,315 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/labstack/echo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// claimsKey keeps the claims of the request's token in the context.
+const claimsKey = "claims"
+
+// The token types, a refresh token only renews the tokens.
+const (
+	accessToken  = "access"
+	refreshToken = "refresh"
+)
+
+// Claims of the tokens, a token acts on behalf of the user.
+// The id of the token is its key in the revocation list.
+type Claims struct {
+	UserId int64  `json:"userId"`
+	Type   string `json:"type"`
+	jwt.StandardClaims
+}
+
+// NewToken signs the access token of the user.
+func (s *Service) NewToken(userId int64) (string, error) {
+	return s.signToken(userId, accessToken, s.cfg.Auth.TokenTTL)
+}
+
+func (s *Service) signToken(userId int64, typ string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := &Claims{
+		UserId: userId,
+		Type:   typ,
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.NewString(),
+			Subject:   strconv.FormatInt(userId, 10),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(s.cfg.Auth.Secret))
+}
+
+func (s *Service) newTokens(userId int64) (tokens Tokens, err error) {
+	tokens.AccessToken, err = s.NewToken(userId)
+	if err != nil {
+		return
+	}
+	tokens.RefreshToken, err = s.signToken(userId, refreshToken, s.cfg.Auth.RefreshTTL)
+	return
+}
+
+// SetPassword replaces the password of the account,
+// e.g. of one registered before the passwords.
+func (s *Service) SetPassword(ctx context.Context, login, password string) error {
+	err := validate(&Credentials{Login: login, Password: password})
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), s.cfg.Auth.BcryptCost)
+	if err != nil {
+		return err
+	}
+	return s.users.SetPassword(ctx, login, string(hash))
+}
+
+// AddUser registers the account, the login should be unique.
+func (s *Service) AddUser(c echo.Context) (err error) {
+	cred := new(Credentials)
+	err = c.Bind(cred)
+	if err != nil {
+		return
+	}
+	err = validate(cred)
+	if err != nil {
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(cred.Password), s.cfg.Auth.BcryptCost)
+	if err != nil {
+		return
+	}
+	u := &User{Login: cred.Login, PasswordHash: string(hash)}
+	err = s.users.AddUser(s.ctx, u)
+	if errors.Is(err, ErrLoginTaken) {
+		return fieldError(http.StatusConflict, "login", err.Error())
+	}
+	if err != nil {
+		return
+	}
+	return c.JSON(http.StatusCreated, u.Id)
+}
+
+// Login issues the tokens of the account.
+func (s *Service) Login(c echo.Context) (err error) {
+	cred := new(Credentials)
+	err = c.Bind(cred)
+	if err != nil {
+		return
+	}
+	u, err := s.users.UserByLogin(s.ctx, cred.Login)
+	if errors.Is(err, ErrUserNotFound) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid login or password")
+	}
+	if err != nil {
+		return
+	}
+	err = bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(cred.Password))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid login or password")
+	}
+	tokens, err := s.newTokens(u.Id)
+	if err != nil {
+		return
+	}
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// Refresh renews the tokens. A refresh token is used once,
+// so a stolen one stops working after its owner refreshes.
+func (s *Service) Refresh(c echo.Context) (err error) {
+	req := new(Tokens)
+	err = c.Bind(req)
+	if err != nil {
+		return
+	}
+	claims, err := s.parseToken(req.RefreshToken)
+	if err != nil || claims.Type != refreshToken {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid refresh token")
+	}
+	fresh, err := s.revoke(claims)
+	if err != nil {
+		return
+	}
+	if !fresh {
+		return echo.NewHTTPError(http.StatusUnauthorized, "revoked token")
+	}
+	tokens, err := s.newTokens(claims.UserId)
+	if err != nil {
+		return
+	}
+	return c.JSON(http.StatusOK, tokens)
+}
+
+// Logout revokes the access token and the refresh token of the optional body.
+func (s *Service) Logout(c echo.Context) (err error) {
+	req := new(Tokens)
+	if c.Request().ContentLength != 0 {
+		err = c.Bind(req)
+		if err != nil {
+			return
+		}
+	}
+	claims, ok := c.Get(claimsKey).(*Claims)
+	if !ok {
+		return echo.NewHTTPError(http.StatusUnauthorized, "missing token")
+	}
+	if req.RefreshToken != "" {
+		refresh, err := s.parseToken(req.RefreshToken)
+		if err != nil || refresh.Type != refreshToken {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid refresh token")
+		}
+		if refresh.UserId != claims.UserId {
+			return echo.NewHTTPError(http.StatusForbidden,
+				"the refresh token belongs to another user")
+		}
+		_, err = s.revoke(refresh)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = s.revoke(claims)
+	if err != nil {
+		return
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// revoke adds the token to the revocation list until it expires
+// and reports whether it was not revoked yet.
+func (s *Service) revoke(claims *Claims) (bool, error) {
+	ttl := time.Until(time.Unix(claims.ExpiresAt, 0))
+	if ttl <= 0 {
+		return false, nil
+	}
+	return s.cache.Revoke(s.ctx, revokedTokenKey(claims.Id), ttl)
+}
+
+func revokedTokenKey(id string) string {
+	return "revoked." + id
+}
+
+// Authenticate rejects the requests without a valid bearer access token
+// and keeps its user as the acting one.
+func (s *Service) Authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return s.authenticate(next, false)
+}
+
+// AuthenticateQuery is Authenticate that also takes the token from the token
+// query parameter of a GET request. It is only meant for the websockets,
+// the event streams and the long polling, which can't set the header,
+// because the query ends up in the access logs.
+func (s *Service) AuthenticateQuery(next echo.HandlerFunc) echo.HandlerFunc {
+	return s.authenticate(next, true)
+}
+
+func (s *Service) authenticate(next echo.HandlerFunc, query bool) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		token := strings.TrimPrefix(req.Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if token == "" && query && req.Method == http.MethodGet {
+			token = c.QueryParam("token")
+		}
+		if token == "" {
+			return echo.NewHTTPError(http.StatusUnauthorized, "missing token")
+		}
+		claims, err := s.parseToken(token)
+		if err != nil || claims.Type != accessToken {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
+		}
+		revoked, err := s.cache.Revoked(s.ctx, revokedTokenKey(claims.Id))
+		if err != nil {
+			return err
+		}
+		if revoked {
+			return echo.NewHTTPError(http.StatusUnauthorized, "revoked token")
+		}
+		c.Set(claimsKey, claims)
+		return next(c)
+	}
+}
+
+func (s *Service) parseToken(token string) (*Claims, error) {
+	claims := new(Claims)
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		// a token signed otherwise could be forged with the secret
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+		}
+		return []byte(s.cfg.Auth.Secret), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims.UserId <= 0 || claims.Id == "" {
+		return nil, errors.New("token has no user or id")
+	}
+	return claims, nil
+}
+
+// actingUser returns the user authenticated by the request's token.
+func actingUser(c echo.Context) (int64, error) {
+	claims, ok := c.Get(claimsKey).(*Claims)
+	if !ok {
+		return 0, echo.NewHTTPError(http.StatusUnauthorized, "missing token")
+	}
+	return claims.UserId, nil
+}
+
+// authorize lets the acting user act only on its own behalf,
+// zero stands for the acting user.
+func authorize(c echo.Context, userId int64) (int64, error) {
+	acting, err := actingUser(c)
+	if err != nil {
+		return 0, err
+	}
+	if userId != 0 && userId != acting {
+		return 0, echo.NewHTTPError(http.StatusForbidden,
+			"acting on behalf of another user")
+	}
+	return acting, nil
+}
+
+// admin lets only the configured admins act.
+func (s *Service) admin(c echo.Context) error {
+	acting, err := actingUser(c)
+	if err != nil {
+		return err
+	}
+	for _, id := range s.cfg.Auth.Admins {
+		if id == acting {
+			return nil
+		}
+	}
+	return echo.NewHTTPError(http.StatusForbidden, "only the admins make announcements")
+}
+
+// feedOwner returns the user of the feed in the path,
+// only its owner may read it.
+func feedOwner(c echo.Context) (int64, error) {
+	userId, err := strconv.ParseInt(c.Param("userId"), 10, 64)
+	if err != nil {
+		return 0, fieldError(http.StatusBadRequest, "userId", "invalid user id")
+	}
+	acting, err := actingUser(c)
+	if err != nil {
+		return 0, err
+	}
+	if userId != acting {
+		return 0, echo.NewHTTPError(http.StatusForbidden,
+			"the feed belongs to another user")
+	}
+	return userId, nil
+}
@@ -0,0 +1,249 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrMalformed rejects a publication that could not be fanned out
+// whenever it is redelivered.
+var ErrMalformed = errors.New("malformed publication")
+
+// FanoutError lists the followers whose feeds missed the publication
+// after all retries, with the last error of every failed batch.
+type FanoutError struct {
+	Publication int64
+	Batches     [][]string
+	Errs        []error
+}
+
+func (e *FanoutError) Error() string {
+	failed := 0
+	errs := make([]string, len(e.Errs))
+	for idx, batch := range e.Batches {
+		failed += len(batch)
+		errs[idx] = e.Errs[idx].Error()
+	}
+	return fmt.Sprintf("publication %d missed %d feeds in %d batches: %s",
+		e.Publication, failed, len(e.Batches), strings.Join(errs, "; "))
+}
+
+// dispatch shards the publications between the fan-out workers by author,
+// so the publications of an author reach the feeds in order. It returns
+// when the workers have fanned out the received publications after
+// the service is cancelled.
+func (s *Service) dispatch(msgs <-chan Delivery) {
+	// the fan-out is aborted when draining takes too long
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-s.ctx.Done():
+			select {
+			case <-ctx.Done():
+			case <-time.After(s.cfg.Timeouts.Drain):
+				log.Println("fan-out drain timed out")
+				cancel()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	shards := make([]chan Delivery, s.cfg.Fanout.Workers)
+	for idx := range shards {
+		shards[idx] = make(chan Delivery, s.cfg.RabbitMQ.Prefetch)
+		wg.Add(1)
+		go func(shard <-chan Delivery) {
+			defer wg.Done()
+			for msg := range shard {
+				s.fanOutDelivery(ctx, msg)
+			}
+		}(shards[idx])
+	}
+	defer func() {
+		for _, shard := range shards {
+			close(shard)
+		}
+		wg.Wait()
+	}()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			select {
+			case shards[shardOf(msg.Body, len(shards))] <- msg:
+			case <-s.ctx.Done():
+				// the publication was not taken by the busy worker
+				err := msg.Nack(true)
+				if err != nil {
+					log.Println(err.Error())
+				}
+				return
+			}
+		}
+	}
+}
+
+// fanOutDelivery acknowledges the publication once it is fanned out.
+// A failed publication is fanned out again by the worker, so the later
+// publications of the author wait for it, and dead-lettered after
+// the redeliveries like a malformed one. It is requeued on shutdown.
+func (s *Service) fanOutDelivery(ctx context.Context, msg Delivery) {
+	err := s.FanOut(ctx, msg.Body)
+	for attempt := 1; attempt <= s.cfg.Fanout.Redeliveries; attempt++ {
+		if err == nil || errors.Is(err, ErrMalformed) {
+			break
+		}
+		log.Println(err.Error())
+		select {
+		case <-ctx.Done():
+		case <-s.ctx.Done():
+		case <-time.After(time.Duration(attempt) * s.cfg.Fanout.RetryBackoff):
+			err = s.FanOut(ctx, msg.Body)
+			continue
+		}
+		// another instance fans it out after the shutdown
+		err = msg.Nack(true)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		return
+	}
+	if err == nil {
+		err = msg.Ack()
+	} else {
+		log.Println(err.Error())
+		err = msg.Nack(false)
+	}
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// shardOf picks the worker by the author of the publication,
+// a malformed one is rejected by any worker.
+func shardOf(msg []byte, workers int) int {
+	var p struct {
+		Author int64 `json:"author"`
+	}
+	if json.Unmarshal(msg, &p) != nil || p.Author < 0 {
+		return 0
+	}
+	return int(p.Author % int64(workers))
+}
+
+// FanOut pushes the serialized publication to the feeds of the author's
+// followers in batches and sends it to their websockets and to the ones
+// subscribed to the author or the hashtags.
+func (s *Service) FanOut(ctx context.Context, body []byte) error {
+	p := new(Publication)
+	err := json.Unmarshal(body, p)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	err = s.pushFeeds(ctx, p, body)
+	if err != nil {
+		return err
+	}
+	s.publishTopics(p, body)
+	return nil
+}
+
+func (s *Service) pushFeeds(ctx context.Context, p *Publication, body []byte) error {
+	celebrity, err := s.isCelebrity(ctx, p.Author)
+	if err != nil {
+		log.Println(err.Error())
+	}
+	if celebrity {
+		// the publication is merged into the feeds on reading
+		marked, err := s.cache.PushAuthor(ctx, p.Author, p.Id, string(body))
+		if err != nil || !marked {
+			return err
+		}
+		return s.announceCelebrity(ctx, p)
+	}
+	followers, err := s.cache.Followers(ctx, p.Author)
+	if err != nil {
+		return err
+	}
+	var fanoutErr *FanoutError
+	for start := 0; start < len(followers); start += s.cfg.Fanout.BatchSize {
+		end := start + s.cfg.Fanout.BatchSize
+		if end > len(followers) {
+			end = len(followers)
+		}
+		batch := followers[start:end]
+		// add publication to the cashed feeds
+		pushed, missing, err := s.pushBatch(ctx, batch, p.Id, string(body))
+		if err != nil {
+			if fanoutErr == nil {
+				fanoutErr = &FanoutError{Publication: p.Id}
+			}
+			fanoutErr.Batches = append(fanoutErr.Batches, batch)
+			fanoutErr.Errs = append(fanoutErr.Errs, err)
+		}
+		// send publication to websockets once, a redelivered
+		// publication is sent only to the feeds missing it. The missing
+		// feeds remember it as well, so their users get it once too.
+		for _, follower := range append(pushed, missing...) {
+			err = s.SendPublicationToExchange(follower, p)
+			if err != nil {
+				log.Println(err.Error())
+			}
+		}
+	}
+	if fanoutErr != nil {
+		return fanoutErr
+	}
+	return nil
+}
+
+// announceCelebrity subscribes the live connections of the followers to
+// the author who has just become a celebrity and sends them the first
+// publication no longer pushed to their topics.
+func (s *Service) announceCelebrity(ctx context.Context, p *Publication) error {
+	followers, err := s.cache.Followers(ctx, p.Author)
+	if err != nil {
+		return err
+	}
+	for _, follower := range followers {
+		err = s.sendToUser(follower, frameCelebrity, celebrity{Author: p.Author})
+		if err == nil {
+			err = s.SendPublicationToExchange(follower, p)
+		}
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *Service) pushBatch(ctx context.Context, followers []string,
+	id int64, pub string) (pushed, missing []string, err error) {
+	for attempt := 0; attempt <= s.cfg.Fanout.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case <-time.After(time.Duration(attempt) * s.cfg.Fanout.RetryBackoff):
+			}
+		}
+		pushed, missing, err = s.cache.PushMany(ctx, followers, id, pub)
+		if err == nil {
+			return pushed, missing, nil
+		}
+	}
+	return nil, nil, err
+}
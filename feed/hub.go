@@ -0,0 +1,277 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+)
+
+// hubConnBuffer is the number of live updates waiting to be sent to
+// a websocket, a slower websocket is disconnected. The updates received
+// while the websocket is replaying its feed are not limited.
+const hubConnBuffer = 64
+
+// hub dispatches the live updates received by the process' queue to its
+// websockets. The queue is bound to a topic while any websocket is
+// subscribed to it.
+type hub struct {
+	broker Broker
+	// bindMu orders the bindings of the concurrent subscriptions
+	bindMu    sync.Mutex
+	listening bool
+	mu        sync.Mutex
+	conns     map[string]map[*hubConn]struct{} // by topic pattern
+}
+
+// hubConn receives the live updates of a websocket,
+// out is closed once it is dropped by the hub.
+type hubConn struct {
+	patterns []string
+	// celebrities are the patterns of the followed celebrities,
+	// they are dropped on unfollowing unless requested too
+	celebrities map[string]bool
+	out         chan []byte
+	dropped     bool
+	// the updates received until the feed is replayed wait in backlog
+	replaying bool
+	backlog   [][]byte
+}
+
+func newHub(broker Broker) *hub {
+	return &hub{
+		broker: broker,
+		conns:  make(map[string]map[*hubConn]struct{}),
+	}
+}
+
+// subscribe registers a websocket receiving the topics matching
+// the patterns and binds the ones new to the process.
+func (h *hub) subscribe(ctx context.Context, patterns []string) (*hubConn, error) {
+	h.bindMu.Lock()
+	defer h.bindMu.Unlock()
+	if !h.listening {
+		msgs, err := h.broker.Listen()
+		if err != nil {
+			return nil, err
+		}
+		h.listening = true
+		go h.run(msgs)
+	}
+	c := &hubConn{
+		celebrities: make(map[string]bool),
+		out:         make(chan []byte, hubConnBuffer),
+		replaying:   true,
+	}
+	err := h.bind(ctx, c, patterns)
+	if err != nil {
+		h.remove(ctx, c)
+		return nil, err
+	}
+	return c, nil
+}
+
+// replayed ends the replay of the websocket's feed and returns the live
+// updates received meanwhile, the next ones are sent to out.
+func (h *hub) replayed(c *hubConn) [][]byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	backlog := c.backlog
+	c.replaying = false
+	c.backlog = nil
+	return backlog
+}
+
+// extend subscribes the websocket to more patterns.
+func (h *hub) extend(ctx context.Context, c *hubConn, patterns []string) error {
+	h.bindMu.Lock()
+	defer h.bindMu.Unlock()
+	h.mu.Lock()
+	for _, pattern := range patterns {
+		delete(c.celebrities, pattern)
+	}
+	h.mu.Unlock()
+	return h.bind(ctx, c, patterns)
+}
+
+// follow subscribes the websocket to the patterns of the followed
+// celebrities, the ones it is already subscribed to are kept on unfollowing.
+func (h *hub) follow(ctx context.Context, c *hubConn, patterns []string) error {
+	h.bindMu.Lock()
+	defer h.bindMu.Unlock()
+	var added []string
+	h.mu.Lock()
+	for _, pattern := range patterns {
+		if _, ok := h.conns[pattern][c]; !ok {
+			c.celebrities[pattern] = true
+			added = append(added, pattern)
+		}
+	}
+	h.mu.Unlock()
+	return h.bind(ctx, c, added)
+}
+
+// unfollow unsubscribes the websocket from the pattern of the unfollowed
+// celebrity and unbinds it if no other websocket is subscribed to it.
+func (h *hub) unfollow(ctx context.Context, c *hubConn, pattern string) {
+	h.bindMu.Lock()
+	defer h.bindMu.Unlock()
+	h.mu.Lock()
+	if !c.celebrities[pattern] {
+		h.mu.Unlock()
+		return
+	}
+	delete(c.celebrities, pattern)
+	patterns := c.patterns[:0]
+	for _, p := range c.patterns {
+		if p != pattern {
+			patterns = append(patterns, p)
+		}
+	}
+	c.patterns = patterns
+	unbind := h.detach(c, []string{pattern})
+	h.mu.Unlock()
+	h.unbind(ctx, unbind)
+}
+
+func (h *hub) bind(ctx context.Context, c *hubConn, patterns []string) error {
+	var bind []string
+	h.mu.Lock()
+	if c.dropped {
+		h.mu.Unlock()
+		return errors.New("websocket is closed")
+	}
+	for _, pattern := range patterns {
+		if _, ok := h.conns[pattern][c]; ok {
+			continue
+		}
+		if h.conns[pattern] == nil {
+			h.conns[pattern] = make(map[*hubConn]struct{})
+			bind = append(bind, pattern)
+		}
+		h.conns[pattern][c] = struct{}{}
+		c.patterns = append(c.patterns, pattern)
+	}
+	h.mu.Unlock()
+	for idx, pattern := range bind {
+		err := h.broker.Bind(ctx, pattern)
+		if err != nil {
+			// the patterns left unbound are only the websocket's
+			h.mu.Lock()
+			for _, pattern := range bind[idx:] {
+				delete(h.conns, pattern)
+			}
+			h.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// unsubscribe removes the websocket and unbinds the topics
+// no other websocket is subscribed to.
+func (h *hub) unsubscribe(ctx context.Context, c *hubConn) {
+	h.bindMu.Lock()
+	defer h.bindMu.Unlock()
+	h.remove(ctx, c)
+}
+
+func (h *hub) remove(ctx context.Context, c *hubConn) {
+	h.mu.Lock()
+	unbind := h.detach(c, c.patterns)
+	h.drop(c)
+	h.mu.Unlock()
+	h.unbind(ctx, unbind)
+}
+
+// detach removes the websocket from the patterns
+// and returns the ones left without websockets.
+func (h *hub) detach(c *hubConn, patterns []string) []string {
+	var unbind []string
+	for _, pattern := range patterns {
+		conns, ok := h.conns[pattern]
+		if !ok {
+			continue
+		}
+		delete(conns, c)
+		if len(conns) == 0 {
+			delete(h.conns, pattern)
+			unbind = append(unbind, pattern)
+		}
+	}
+	return unbind
+}
+
+func (h *hub) unbind(ctx context.Context, patterns []string) {
+	for _, pattern := range patterns {
+		err := h.broker.Unbind(ctx, pattern)
+		if err != nil {
+			log.Printf("unbind %s: %v", pattern, err)
+		}
+	}
+}
+
+// run dispatches the live updates until the broker is closed,
+// then it drops all websockets.
+func (h *hub) run(msgs <-chan Delivery) {
+	for msg := range msgs {
+		h.dispatch(msg)
+		err := msg.Ack()
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}
+	h.bindMu.Lock()
+	h.listening = false
+	h.bindMu.Unlock()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, conns := range h.conns {
+		for c := range conns {
+			h.drop(c)
+		}
+	}
+}
+
+// dispatch sends the live update once to every websocket subscribed
+// to a pattern matching its topic.
+func (h *hub) dispatch(msg Delivery) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sent := make(map[*hubConn]bool)
+	send := func(conns map[*hubConn]struct{}) {
+		for c := range conns {
+			if sent[c] || c.dropped {
+				continue
+			}
+			sent[c] = true
+			if c.replaying {
+				c.backlog = append(c.backlog, msg.Body)
+				continue
+			}
+			select {
+			case c.out <- msg.Body:
+			default:
+				log.Printf("dropping slow websocket of %s", msg.Topic)
+				h.drop(c)
+			}
+		}
+	}
+	// the users' topics are looked up, the wildcards are matched
+	send(h.conns[msg.Topic])
+	for pattern, conns := range h.conns {
+		if pattern != msg.Topic && strings.ContainsAny(pattern, "*#") &&
+			topicMatches(pattern, msg.Topic) {
+			send(conns)
+		}
+	}
+}
+
+// drop closes the websocket's updates, it is removed on unsubscribe.
+func (h *hub) drop(c *hubConn) {
+	if !c.dropped {
+		c.dropped = true
+		close(c.out)
+	}
+}
@@ -0,0 +1,886 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps users, followers and publications in process memory.
+type MemoryStore struct {
+	mu           sync.Mutex
+	users        map[int64]User
+	followers    map[Follower]struct{}
+	publications []Publication
+	outbox       []memoryOutboxEntry
+}
+
+type memoryOutboxEntry struct {
+	OutboxEntry
+	sent bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:     make(map[int64]User),
+		followers: make(map[Follower]struct{}),
+	}
+}
+
+func (m *MemoryStore) AddUser(ctx context.Context, u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, user := range m.users {
+		if user.Login == u.Login {
+			return ErrLoginTaken
+		}
+	}
+	u.Id = int64(len(m.users) + 1)
+	m.users[u.Id] = *u
+	return nil
+}
+
+func (m *MemoryStore) UserByLogin(ctx context.Context, login string) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, user := range m.users {
+		if user.Login == login {
+			return &user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
+func (m *MemoryStore) SetPassword(ctx context.Context, login, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, user := range m.users {
+		if user.Login == login {
+			user.PasswordHash = hash
+			m.users[id] = user
+			return nil
+		}
+	}
+	return ErrUserNotFound
+}
+
+func (m *MemoryStore) UserIds(ctx context.Context, afterId int64, limit int) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ids := make([]int64, 0, limit)
+	// ids are assigned sequentially
+	for id := afterId + 1; id <= int64(len(m.users)) && len(ids) < limit; id++ {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (m *MemoryStore) AddFollower(ctx context.Context, f *Follower) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkUsers(f.UserId, f.FollowerId); err != nil {
+		return false, err
+	}
+	if _, ok := m.followers[*f]; ok {
+		return false, ErrAlreadyFollows
+	}
+	m.followers[*f] = struct{}{}
+	return true, nil
+}
+
+func (m *MemoryStore) RemoveFollower(ctx context.Context, f *Follower) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.followers[*f]
+	delete(m.followers, *f)
+	return ok, nil
+}
+
+func (m *MemoryStore) FollowerIds(ctx context.Context,
+	userIds []int64) (map[int64][]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	followers := make(map[int64][]int64, len(userIds))
+	for _, userId := range userIds {
+		for f := range m.followers {
+			if f.UserId == userId {
+				followers[userId] = append(followers[userId], f.FollowerId)
+			}
+		}
+	}
+	return followers, nil
+}
+
+func (m *MemoryStore) FollowingIds(ctx context.Context,
+	afterId int64, limit int) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	following := make(map[int64]bool)
+	for f := range m.followers {
+		if f.FollowerId > afterId {
+			following[f.FollowerId] = true
+		}
+	}
+	ids := make([]int64, 0, len(following))
+	for id := range following {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+func (m *MemoryStore) FolloweeIds(ctx context.Context,
+	followerIds []int64) (map[int64][]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	followees := make(map[int64][]int64, len(followerIds))
+	for _, followerId := range followerIds {
+		for f := range m.followers {
+			if f.FollowerId == followerId {
+				followees[followerId] = append(followees[followerId], f.UserId)
+			}
+		}
+	}
+	return followees, nil
+}
+
+func (m *MemoryStore) AddPublication(ctx context.Context, p *Publication) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkUsers(p.Author); err != nil {
+		return err
+	}
+	p.Id = int64(len(m.publications) + 1)
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	m.publications = append(m.publications, *p)
+	m.outbox = append(m.outbox, memoryOutboxEntry{
+		OutboxEntry: OutboxEntry{Id: int64(len(m.outbox) + 1), Body: body},
+	})
+	return nil
+}
+
+func (m *MemoryStore) PendingOutbox(ctx context.Context, limit int) ([]OutboxEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []OutboxEntry
+	for _, entry := range m.outbox {
+		if len(entries) == limit {
+			break
+		}
+		if !entry.sent {
+			entries = append(entries, entry.OutboxEntry)
+		}
+	}
+	return entries, nil
+}
+
+func (m *MemoryStore) MarkSent(ctx context.Context, ids []int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// ids are assigned sequentially
+	for _, id := range ids {
+		if id > 0 && id <= int64(len(m.outbox)) {
+			m.outbox[id-1].sent = true
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) Feed(ctx context.Context, userId int64,
+	cursor Cursor, limit int) ([]Publication, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pubs := make([]Publication, 0, limit)
+	if cursor.After {
+		// take the publications next to the cursor
+		for _, p := range m.publications {
+			if len(pubs) == limit {
+				break
+			}
+			if m.follows(userId, p.Author) && cursor.Admits(&p) {
+				pubs = append(pubs, p)
+			}
+		}
+		reverse(pubs)
+		return pubs, nil
+	}
+	for idx := len(m.publications) - 1; idx >= 0 && len(pubs) < limit; idx-- {
+		p := m.publications[idx]
+		if m.follows(userId, p.Author) && cursor.Admits(&p) {
+			pubs = append(pubs, p)
+		}
+	}
+	return pubs, nil
+}
+
+func (m *MemoryStore) Recent(ctx context.Context, author int64, limit int) ([]Publication, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pubs := make([]Publication, 0, limit)
+	for idx := len(m.publications) - 1; idx >= 0 && len(pubs) < limit; idx-- {
+		if m.publications[idx].Author == author {
+			pubs = append(pubs, m.publications[idx])
+		}
+	}
+	return pubs, nil
+}
+
+func (m *MemoryStore) Feeds(ctx context.Context,
+	userIds []int64, limit int) (map[int64][]Publication, error) {
+	feeds := make(map[int64][]Publication, len(userIds))
+	for _, userId := range userIds {
+		pubs, err := m.Feed(ctx, userId, Cursor{}, limit)
+		if err != nil {
+			return nil, err
+		}
+		if len(pubs) > 0 {
+			feeds[userId] = pubs
+		}
+	}
+	return feeds, nil
+}
+
+func (m *MemoryStore) follows(followerId, userId int64) bool {
+	_, ok := m.followers[Follower{UserId: userId, FollowerId: followerId}]
+	return ok
+}
+
+func (m *MemoryStore) checkUsers(userIds ...int64) error {
+	for _, userId := range userIds {
+		if _, ok := m.users[userId]; !ok {
+			return fmt.Errorf("user %d: %w", userId, ErrUserNotFound)
+		}
+	}
+	return nil
+}
+
+// MemoryCache keeps the followedBy sets and the feeds in process memory.
+type MemoryCache struct {
+	mu          sync.Mutex
+	sets        map[string]map[string]struct{}
+	lists       map[string][]string
+	locks       map[string]memoryLock
+	revoked     map[string]time.Time
+	empty       map[string]time.Time // feeds cached as empty
+	checkpoints map[string]int64
+	feedMaxSize int64
+}
+
+func NewMemoryCache(feedMaxSize int64) *MemoryCache {
+	return &MemoryCache{
+		sets:        make(map[string]map[string]struct{}),
+		lists:       make(map[string][]string),
+		locks:       make(map[string]memoryLock),
+		revoked:     make(map[string]time.Time),
+		empty:       make(map[string]time.Time),
+		checkpoints: make(map[string]int64),
+		feedMaxSize: feedMaxSize,
+	}
+}
+
+func (m *MemoryCache) AddFollower(ctx context.Context, userId, followerId int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addMember(followedSetKey(userId), followerId)
+	m.addMember(followsSetKey(followerId), userId)
+	return nil
+}
+
+func (m *MemoryCache) addMember(key string, id int64) {
+	if m.sets[key] == nil {
+		m.sets[key] = make(map[string]struct{})
+	}
+	m.sets[key][strconv.FormatInt(id, 10)] = struct{}{}
+}
+
+func (m *MemoryCache) RemoveFollower(ctx context.Context, userId, followerId int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sets[followedSetKey(userId)], strconv.FormatInt(followerId, 10))
+	delete(m.sets[followsSetKey(followerId)], strconv.FormatInt(userId, 10))
+	return nil
+}
+
+func (m *MemoryCache) Followers(ctx context.Context, userId int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	set := m.sets[followedSetKey(userId)]
+	followers := make([]string, 0, len(set))
+	for follower := range set {
+		followers = append(followers, follower)
+	}
+	return followers, nil
+}
+
+func (m *MemoryCache) FollowerCount(ctx context.Context, userId int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.sets[followedSetKey(userId)])), nil
+}
+
+func (m *MemoryCache) Followees(ctx context.Context, followerId int64) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	set := m.sets[followsSetKey(followerId)]
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	return parseIds(members)
+}
+
+func (m *MemoryCache) Feed(ctx context.Context, userId string, start, stop int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := m.lists[userId]
+	if start >= int64(len(list)) || start > stop {
+		return []string{}, nil
+	}
+	if stop >= int64(len(list)) {
+		stop = int64(len(list)) - 1
+	}
+	return append([]string{}, list[start:stop+1]...), nil
+}
+
+func (m *MemoryCache) PushMany(ctx context.Context,
+	userIds []string, id int64, pub string) (pushed, missing []string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, userId := range userIds {
+		result, err := m.push(userId, id, pub, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch result {
+		case pushInserted:
+			pushed = append(pushed, userId)
+		case pushMissing:
+			missing = append(missing, userId)
+		}
+	}
+	return pushed, missing, nil
+}
+
+// push prepends the publication unless the list contains its id
+// or it is older than the whole full list, like pushScript does.
+// A missing list is created only if create is set or it is cached
+// as empty, otherwise the id is remembered to skip it when it is pushed again.
+func (m *MemoryCache) push(key string, id int64, pub string, create bool) (int64, error) {
+	if len(m.lists[key]) == 0 && m.empty[key].After(time.Now()) {
+		create = true
+	}
+	delete(m.empty, key)
+	if len(m.lists[key]) == 0 && !create {
+		if !m.rememberId(feedIdsKey(key), id) {
+			return pushSkipped, nil
+		}
+		return pushMissing, nil
+	}
+	oldest := id
+	for _, item := range m.lists[key] {
+		itemId, err := publicationId(item)
+		if err != nil {
+			return pushSkipped, err
+		}
+		if itemId == id {
+			return pushSkipped, nil
+		}
+		if itemId < oldest {
+			oldest = itemId
+		}
+	}
+	if int64(len(m.lists[key])) > m.feedMaxSize && oldest == id {
+		return pushSkipped, nil
+	}
+	list := append([]string{pub}, m.lists[key]...)
+	// feed should contain no more than feedMaxSize items
+	if int64(len(list)) > m.feedMaxSize+1 {
+		list = list[:m.feedMaxSize+1]
+	}
+	m.lists[key] = list
+	return pushInserted, nil
+}
+
+// rememberId adds the id to the ids of a missing feed and keeps the newest
+// feedMaxSize + 1 of them like pushScript, it reports whether the id is new
+// and kept.
+func (m *MemoryCache) rememberId(idsKey string, id int64) bool {
+	member := strconv.FormatInt(id, 10)
+	if _, ok := m.sets[idsKey][member]; ok {
+		return false
+	}
+	if m.sets[idsKey] == nil {
+		m.sets[idsKey] = make(map[string]struct{})
+	}
+	m.sets[idsKey][member] = struct{}{}
+	if int64(len(m.sets[idsKey])) <= m.feedMaxSize+1 {
+		return true
+	}
+	// drop the oldest id
+	oldest := id
+	for member := range m.sets[idsKey] {
+		itemId, _ := strconv.ParseInt(member, 10, 64)
+		if itemId < oldest {
+			oldest = itemId
+		}
+	}
+	delete(m.sets[idsKey], strconv.FormatInt(oldest, 10))
+	return oldest != id
+}
+
+func (m *MemoryCache) Remove(ctx context.Context, userId string, pub string) error {
+	id, err := publicationId(pub)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sets[feedIdsKey(userId)], strconv.FormatInt(id, 10))
+	list := m.lists[userId][:0]
+	for _, item := range m.lists[userId] {
+		if item != pub {
+			list = append(list, item)
+		}
+	}
+	m.lists[userId] = list
+	return nil
+}
+
+func (m *MemoryCache) Update(ctx context.Context, userId string,
+	update func(pubs []string) ([]string, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pubs, err := update(append([]string{}, m.lists[userId]...))
+	if err != nil {
+		return err
+	}
+	if int64(len(pubs)) > m.feedMaxSize+1 {
+		pubs = pubs[:m.feedMaxSize+1]
+	}
+	m.lists[userId] = pubs
+	delete(m.empty, userId)
+	return nil
+}
+
+func (m *MemoryCache) Fill(ctx context.Context, userId string, emptyTTL time.Duration,
+	load func() ([]string, error)) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.lists[userId]) > 0 || m.empty[userId].After(time.Now()) {
+		return false, nil
+	}
+	pubs, err := load()
+	if err != nil {
+		return false, err
+	}
+	if len(pubs) == 0 {
+		if emptyTTL > 0 {
+			m.empty[userId] = time.Now().Add(emptyTTL)
+		}
+		return false, nil
+	}
+	if int64(len(pubs)) > m.feedMaxSize+1 {
+		pubs = pubs[:m.feedMaxSize+1]
+	}
+	m.lists[userId] = append([]string{}, pubs...)
+	return true, nil
+}
+
+func (m *MemoryCache) FeedEmpty(ctx context.Context, userId string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.empty[userId].After(time.Now()), nil
+}
+
+type memoryLock struct {
+	token   string
+	expires time.Time
+}
+
+func (m *MemoryCache) Lock(ctx context.Context,
+	key, token string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.locks[key].expires.After(time.Now()) {
+		return false, nil
+	}
+	m.locks[key] = memoryLock{token, time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (m *MemoryCache) Extend(ctx context.Context,
+	key, token string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lock := m.locks[key]
+	if lock.token != token || !lock.expires.After(time.Now()) {
+		return false, nil
+	}
+	m.locks[key] = memoryLock{token, time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (m *MemoryCache) Unlock(ctx context.Context, key, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.locks[key].token == token {
+		delete(m.locks, key)
+	}
+	return nil
+}
+
+func (m *MemoryCache) Revoke(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.revoked[key].After(time.Now()) {
+		return false, nil
+	}
+	m.revoked[key] = time.Now().Add(ttl)
+	return true, nil
+}
+
+func (m *MemoryCache) Revoked(ctx context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.revoked[key].After(time.Now()), nil
+}
+
+func (m *MemoryCache) ReplaceFollowers(ctx context.Context,
+	followers, followees map[int64][]int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for userId, followerIds := range followers {
+		m.replaceSet(followedSetKey(userId), followerIds)
+	}
+	for followerId, userIds := range followees {
+		m.replaceSet(followsSetKey(followerId), userIds)
+	}
+	return nil
+}
+
+func (m *MemoryCache) replaceSet(key string, ids []int64) {
+	set := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		set[strconv.FormatInt(id, 10)] = struct{}{}
+	}
+	m.sets[key] = set
+}
+
+func (m *MemoryCache) ReplaceFeeds(ctx context.Context, feeds map[string][]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for userId, pubs := range feeds {
+		if int64(len(pubs)) > m.feedMaxSize+1 {
+			pubs = pubs[:m.feedMaxSize+1]
+		}
+		m.lists[userId] = append([]string{}, pubs...)
+		delete(m.empty, userId)
+	}
+	return nil
+}
+
+func (m *MemoryCache) Checkpoint(ctx context.Context, name string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checkpoints[name], nil
+}
+
+func (m *MemoryCache) SetCheckpoint(ctx context.Context, name string, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id == 0 {
+		delete(m.checkpoints, name)
+	} else {
+		m.checkpoints[name] = id
+	}
+	return nil
+}
+
+func (m *MemoryCache) PushAuthor(ctx context.Context,
+	author int64, id int64, pub string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.push(authorFeedKey(author), id, pub, true)
+	if err != nil {
+		return false, err
+	}
+	if m.sets[celebritiesKey] == nil {
+		m.sets[celebritiesKey] = make(map[string]struct{})
+	}
+	member := strconv.FormatInt(author, 10)
+	_, marked := m.sets[celebritiesKey][member]
+	m.sets[celebritiesKey][member] = struct{}{}
+	return !marked, nil
+}
+
+func (m *MemoryCache) ReplaceCelebrities(ctx context.Context,
+	userIds []int64, feeds map[int64][]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sets[celebritiesKey] == nil {
+		m.sets[celebritiesKey] = make(map[string]struct{})
+	}
+	for _, userId := range userIds {
+		key := authorFeedKey(userId)
+		member := strconv.FormatInt(userId, 10)
+		delete(m.sets, feedIdsKey(key))
+		pubs, ok := feeds[userId]
+		if !ok {
+			delete(m.lists, key)
+			delete(m.sets[celebritiesKey], member)
+			continue
+		}
+		if int64(len(pubs)) > m.feedMaxSize+1 {
+			pubs = pubs[:m.feedMaxSize+1]
+		}
+		m.lists[key] = append([]string{}, pubs...)
+		m.sets[celebritiesKey][member] = struct{}{}
+	}
+	return nil
+}
+
+func (m *MemoryCache) Celebrities(ctx context.Context, userIds []int64) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var celebrities []int64
+	for _, userId := range userIds {
+		if _, ok := m.sets[celebritiesKey][strconv.FormatInt(userId, 10)]; ok {
+			celebrities = append(celebrities, userId)
+		}
+	}
+	return celebrities, nil
+}
+
+func (m *MemoryCache) AuthorFeeds(ctx context.Context,
+	authors []int64, stop int64) ([][]string, error) {
+	feeds := make([][]string, len(authors))
+	for idx, author := range authors {
+		pubs, err := m.Feed(ctx, authorFeedKey(author), 0, stop)
+		if err != nil {
+			return nil, err
+		}
+		feeds[idx] = pubs
+	}
+	return feeds, nil
+}
+
+// MemoryBroker carries publications between goroutines of one process.
+type MemoryBroker struct {
+	mu          sync.Mutex
+	queue       *memoryQueue
+	live        *memoryQueue
+	bindings    map[string]bool
+	deadLetters []DeadLetter
+	closed      bool
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	m := &MemoryBroker{
+		// the rejected live updates are dropped like in RabbitMQ
+		live:     newMemoryQueue(nil),
+		bindings: make(map[string]bool),
+	}
+	m.queue = newMemoryQueue(m.deadLetter)
+	return m
+}
+
+func (m *MemoryBroker) Publish(ctx context.Context, body []byte) error {
+	m.mu.Lock()
+	closed := m.closed
+	m.mu.Unlock()
+	if closed {
+		return ErrDisconnected
+	}
+	m.queue.push(body)
+	return nil
+}
+
+func (m *MemoryBroker) PublishTopic(ctx context.Context, topic string, body []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// the queue gets the message once like in RabbitMQ
+	for pattern := range m.bindings {
+		if topicMatches(pattern, topic) {
+			m.live.pushTopic(topic, body)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBroker) Consume() (<-chan Delivery, error) {
+	return m.queue.out, nil
+}
+
+func (m *MemoryBroker) Listen() (<-chan Delivery, error) {
+	return m.live.out, nil
+}
+
+func (m *MemoryBroker) Bind(ctx context.Context, pattern string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrDisconnected
+	}
+	m.bindings[pattern] = true
+	return nil
+}
+
+func (m *MemoryBroker) Unbind(ctx context.Context, pattern string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.bindings, pattern)
+	return nil
+}
+
+func (m *MemoryBroker) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]DeadLetter(nil), m.deadLetters...), nil
+}
+
+func (m *MemoryBroker) ReplayDeadLetters(ctx context.Context) (int, error) {
+	m.mu.Lock()
+	deadLetters := m.deadLetters
+	m.deadLetters = nil
+	m.mu.Unlock()
+	for _, deadLetter := range deadLetters {
+		m.queue.push(deadLetter.Body)
+	}
+	return len(deadLetters), nil
+}
+
+func (m *MemoryBroker) State() BrokerState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return BrokerClosed
+	}
+	return BrokerConnected
+}
+
+func (m *MemoryBroker) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	m.live.close()
+	m.queue.close()
+	return nil
+}
+
+func (m *MemoryBroker) deadLetter(body []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deadLetters = append(m.deadLetters, DeadLetter{
+		Body:   body,
+		Reason: "rejected",
+		Count:  1,
+		At:     time.Now(),
+	})
+}
+
+// memoryQueue is an unbounded queue drained into the out channel,
+// a rejected publication is pushed back or passed to dead.
+type memoryQueue struct {
+	mu     sync.Mutex
+	items  []memoryMessage
+	ready  chan struct{}
+	done   chan struct{}
+	out    chan Delivery
+	dead   func(body []byte)
+	closed bool
+}
+
+func newMemoryQueue(dead func(body []byte)) *memoryQueue {
+	q := &memoryQueue{
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+		out:   make(chan Delivery),
+		dead:  dead,
+	}
+	go q.drain()
+	return q
+}
+
+type memoryMessage struct {
+	topic string
+	body  []byte
+}
+
+func (q *memoryQueue) push(body []byte) {
+	q.pushTopic("", body)
+}
+
+func (q *memoryQueue) pushTopic(topic string, body []byte) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	q.items = append(q.items, memoryMessage{topic, body})
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *memoryQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+	}
+}
+
+func (q *memoryQueue) drain() {
+	defer close(q.out)
+	for {
+		q.mu.Lock()
+		var msg *memoryMessage
+		if len(q.items) > 0 {
+			msg = &q.items[0]
+			q.items = q.items[1:]
+		}
+		q.mu.Unlock()
+		if msg == nil {
+			select {
+			case <-q.ready:
+				continue
+			case <-q.done:
+				return
+			}
+		}
+		select {
+		case q.out <- q.delivery(*msg):
+		case <-q.done:
+			return
+		}
+	}
+}
+
+func (q *memoryQueue) delivery(msg memoryMessage) Delivery {
+	return Delivery{
+		Topic: msg.topic,
+		Body:  msg.body,
+		Ack:   func() error { return nil },
+		Nack: func(requeue bool) error {
+			if requeue {
+				q.pushTopic(msg.topic, msg.body)
+			} else if q.dead != nil {
+				q.dead(msg.body)
+			}
+			return nil
+		},
+	}
+}
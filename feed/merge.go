@@ -0,0 +1,158 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+)
+
+// mergeFeeds merges the feeds ordered newest first into one, publications
+// repeated by id are taken from the first feed containing them. The order
+// of ids is the order of publishing.
+func mergeFeeds(feeds ...[]Publication) []Publication {
+	var merged []Publication
+	for _, feed := range feeds {
+		merged = mergeTwo(merged, feed)
+	}
+	return merged
+}
+
+func mergeTwo(a, b []Publication) []Publication {
+	merged := make([]Publication, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case j == len(b) || i < len(a) && a[i].Id > b[j].Id:
+			merged = append(merged, a[i])
+			i++
+		case i == len(a) || b[j].Id > a[i].Id:
+			merged = append(merged, b[j])
+			j++
+		default:
+			merged = append(merged, a[i])
+			i++
+			j++
+		}
+	}
+	return merged
+}
+
+// backfillFeed merges the recent publications of the followed user into
+// the follower's feed and sends the merged ones to the websockets.
+func (s *Service) backfillFeed(ctx context.Context, f *Follower) error {
+	if s.cfg.Feed.BackfillSize <= 0 {
+		return nil
+	}
+	followerId := strconv.FormatInt(f.FollowerId, 10)
+	// the publications already in the feed were shown, the ones of
+	// a feed rebuilt below were not
+	items, err := s.cache.Feed(ctx, followerId, 0, s.cfg.Feed.MaxSize)
+	if err != nil {
+		return err
+	}
+	shown := make(map[int64]bool, len(items))
+	for _, item := range items {
+		id, err := publicationId(item)
+		if err != nil {
+			return err
+		}
+		shown[id] = true
+	}
+	// a missing feed is rebuilt in full instead
+	err = s.EnsureFeed(ctx, f.FollowerId)
+	if err != nil {
+		return err
+	}
+	recent, err := s.publications.Recent(ctx, f.UserId, s.cfg.Feed.BackfillSize)
+	if err != nil || len(recent) == 0 {
+		return err
+	}
+	backfilled := make(map[int64]bool, len(recent))
+	for _, p := range recent {
+		backfilled[p.Id] = true
+	}
+	var added []Publication
+	err = s.cache.Update(ctx, followerId, func(items []string) ([]string, error) {
+		pubs, err := decodeFeed(items)
+		if err != nil {
+			return nil, err
+		}
+		raw := make(map[int64]string, len(items))
+		for idx, p := range pubs {
+			raw[p.Id] = items[idx]
+		}
+		sortFeed(pubs)
+		merged := mergeFeeds(pubs, recent)
+		if int64(len(merged)) > s.cfg.Feed.MaxSize+1 {
+			merged = merged[:s.cfg.Feed.MaxSize+1]
+		}
+		added = added[:0]
+		items = make([]string, len(merged))
+		for idx := range merged {
+			if backfilled[merged[idx].Id] && !shown[merged[idx].Id] {
+				added = append(added, merged[idx])
+			}
+			item, ok := raw[merged[idx].Id]
+			if !ok {
+				data, err := json.Marshal(&merged[idx])
+				if err != nil {
+					return nil, err
+				}
+				item = string(data)
+			}
+			items[idx] = item
+		}
+		return items, nil
+	})
+	if err != nil {
+		return err
+	}
+	// the oldest publications are sent first like the fan-out does
+	for idx := len(added) - 1; idx >= 0; idx-- {
+		err = s.SendPublicationToExchange(followerId, &added[idx])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortFeed orders the publications newest first.
+func sortFeed(pubs []Publication) {
+	sort.SliceStable(pubs, func(i, j int) bool {
+		return pubs[i].Id > pubs[j].Id
+	})
+}
+
+// publicationId decodes only the id of the serialized publication.
+func publicationId(pub string) (int64, error) {
+	var p struct {
+		Id int64 `json:"id"`
+	}
+	err := json.Unmarshal([]byte(pub), &p)
+	return p.Id, err
+}
+
+func decodeFeed(items []string) ([]Publication, error) {
+	pubs := make([]Publication, len(items))
+	for idx, item := range items {
+		err := json.Unmarshal([]byte(item), &pubs[idx])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pubs, nil
+}
+
+func encodeFeed(pubs []Publication) ([]string, error) {
+	items := make([]string, len(pubs))
+	for idx := range pubs {
+		item, err := json.Marshal(&pubs[idx])
+		if err != nil {
+			return nil, err
+		}
+		items[idx] = string(item)
+	}
+	return items, nil
+}
@@ -0,0 +1,391 @@
+package feed
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// The MySQL errors of the violated constraints.
+const (
+	errDuplicateEntry  = 1062
+	errNoReferencedRow = 1452
+)
+
+// constraintError maps the violated constraints to the store errors,
+// the foreign keys reference the users.
+func constraintError(err error, duplicate error) error {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch {
+		case mysqlErr.Number == errDuplicateEntry && duplicate != nil:
+			return duplicate
+		case mysqlErr.Number == errNoReferencedRow:
+			return ErrUserNotFound
+		}
+	}
+	return err
+}
+
+// MySQLStore keeps users, followers and publications in MySQL.
+type MySQLStore struct {
+	db *sql.DB
+}
+
+func NewMySQLStore(db *sql.DB) *MySQLStore {
+	return &MySQLStore{db}
+}
+
+func (m *MySQLStore) AddUser(ctx context.Context, u *User) (err error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			_ = tx.Rollback()
+		}
+	}()
+	if err != nil {
+		return
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO users (login, password) values (?, ?);`,
+		u.Login, u.PasswordHash)
+	if err != nil {
+		return constraintError(err, ErrLoginTaken)
+	}
+	row := tx.QueryRowContext(ctx, `SELECT LAST_INSERT_ID();`)
+	return row.Scan(&u.Id)
+}
+
+func (m *MySQLStore) UserByLogin(ctx context.Context, login string) (*User, error) {
+	u := &User{Login: login}
+	row := m.db.QueryRowContext(ctx,
+		`SELECT id, password FROM users WHERE login = ?;`, login)
+	err := row.Scan(&u.Id, &u.PasswordHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (m *MySQLStore) SetPassword(ctx context.Context, login, hash string) error {
+	res, err := m.db.ExecContext(ctx,
+		`UPDATE users SET password = ? WHERE login = ?;`, hash, login)
+	if err != nil {
+		return err
+	}
+	found, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if found == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (m *MySQLStore) UserIds(ctx context.Context, afterId int64, limit int) ([]int64, error) {
+	rows, err := m.db.QueryContext(ctx,
+		`SELECT id FROM users WHERE id > ? ORDER BY id LIMIT ?;`,
+		afterId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]int64, 0, limit)
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (m *MySQLStore) AddFollower(ctx context.Context, f *Follower) (bool, error) {
+	tag, err := m.db.ExecContext(ctx,
+		`INSERT INTO followers (userId, followerId) values (?, ?);`,
+		f.UserId, f.FollowerId)
+	if err != nil {
+		return false, constraintError(err, ErrAlreadyFollows)
+	}
+	rowsAffected, err := tag.RowsAffected()
+	return rowsAffected == 1, err
+}
+
+func (m *MySQLStore) RemoveFollower(ctx context.Context, f *Follower) (bool, error) {
+	tag, err := m.db.ExecContext(ctx,
+		`DELETE FROM followers WHERE userId = ? && followerId = ?;`,
+		f.UserId, f.FollowerId)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := tag.RowsAffected()
+	return rowsAffected == 1, err
+}
+
+func (m *MySQLStore) FollowerIds(ctx context.Context,
+	userIds []int64) (map[int64][]int64, error) {
+	followers := make(map[int64][]int64, len(userIds))
+	if len(userIds) == 0 {
+		return followers, nil
+	}
+	args := make([]interface{}, len(userIds))
+	for idx, userId := range userIds {
+		args[idx] = userId
+	}
+	rows, err := m.db.QueryContext(ctx,
+		`SELECT userId, followerId FROM followers WHERE userId IN (?`+
+			strings.Repeat(`, ?`, len(userIds)-1)+`);`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userId, followerId int64
+		err = rows.Scan(&userId, &followerId)
+		if err != nil {
+			return nil, err
+		}
+		followers[userId] = append(followers[userId], followerId)
+	}
+	return followers, rows.Err()
+}
+
+func (m *MySQLStore) FollowingIds(ctx context.Context,
+	afterId int64, limit int) ([]int64, error) {
+	rows, err := m.db.QueryContext(ctx,
+		`SELECT DISTINCT followerId FROM followers
+		WHERE followerId > ? ORDER BY followerId LIMIT ?;`,
+		afterId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]int64, 0, limit)
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (m *MySQLStore) FolloweeIds(ctx context.Context,
+	followerIds []int64) (map[int64][]int64, error) {
+	followees := make(map[int64][]int64, len(followerIds))
+	if len(followerIds) == 0 {
+		return followees, nil
+	}
+	args := make([]interface{}, len(followerIds))
+	for idx, followerId := range followerIds {
+		args[idx] = followerId
+	}
+	rows, err := m.db.QueryContext(ctx,
+		`SELECT followerId, userId FROM followers WHERE followerId IN (?`+
+			strings.Repeat(`, ?`, len(followerIds)-1)+`);`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var followerId, userId int64
+		err = rows.Scan(&followerId, &userId)
+		if err != nil {
+			return nil, err
+		}
+		followees[followerId] = append(followees[followerId], userId)
+	}
+	return followees, rows.Err()
+}
+
+func (m *MySQLStore) AddPublication(ctx context.Context, p *Publication) (err error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	defer func() {
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			_ = tx.Rollback()
+		}
+	}()
+	if err != nil {
+		return
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO publications (author, txt, createdAt) values (?, ?, ?);`,
+		p.Author, p.Text, p.At)
+	if err != nil {
+		return constraintError(err, nil)
+	}
+	row := tx.QueryRowContext(ctx, `SELECT LAST_INSERT_ID();`)
+	err = row.Scan(&p.Id)
+	if err != nil {
+		return
+	}
+	// the relay sends the publication to the fan-out after the commit
+	body, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO outbox (publicationId, payload, createdAt) values (?, ?, ?);`,
+		p.Id, body, p.At)
+	return
+}
+
+func (m *MySQLStore) PendingOutbox(ctx context.Context, limit int) ([]OutboxEntry, error) {
+	rows, err := m.db.QueryContext(ctx,
+		`SELECT id, payload FROM outbox WHERE sentAt IS NULL ORDER BY id LIMIT ?;`,
+		limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []OutboxEntry
+	for rows.Next() {
+		var entry OutboxEntry
+		err = rows.Scan(&entry.Id, &entry.Body)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (m *MySQLStore) MarkSent(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(ids)+1)
+	args[0] = time.Now()
+	for idx, id := range ids {
+		args[idx+1] = id
+	}
+	_, err := m.db.ExecContext(ctx,
+		`UPDATE outbox SET sentAt = ? WHERE id IN (?`+
+			strings.Repeat(`, ?`, len(ids)-1)+`);`, args...)
+	return err
+}
+
+func (m *MySQLStore) Feed(ctx context.Context, userId int64,
+	cursor Cursor, limit int) ([]Publication, error) {
+	query := `SELECT p.id, p.author, p.txt, p.createdAt FROM publications p
+		JOIN followers f ON f.userId = p.author
+		WHERE f.followerId = ?`
+	args := []interface{}{userId}
+	direction := " DESC"
+	if cursor.After {
+		// take the publications next to the cursor
+		direction = " ASC"
+	}
+	order := "p.id" + direction
+	switch {
+	case cursor.Id > 0 && cursor.After:
+		query += ` AND p.id > ?`
+		args = append(args, cursor.Id)
+	case cursor.Id > 0:
+		query += ` AND p.id < ?`
+		args = append(args, cursor.Id)
+	case !cursor.At.IsZero() && cursor.After:
+		query += ` AND p.createdAt > ?`
+		args = append(args, cursor.At)
+		order = "p.createdAt" + direction + ", " + order
+	case !cursor.At.IsZero():
+		query += ` AND p.createdAt < ?`
+		args = append(args, cursor.At)
+		order = "p.createdAt" + direction + ", " + order
+	}
+	query += ` ORDER BY ` + order + ` LIMIT ?;`
+	args = append(args, limit)
+	rows, err := m.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pubs := make([]Publication, 0, limit)
+	for rows.Next() {
+		var p Publication
+		err = rows.Scan(&p.Id, &p.Author, &p.Text, &p.At)
+		if err != nil {
+			return nil, err
+		}
+		pubs = append(pubs, p)
+	}
+	if cursor.After {
+		reverse(pubs)
+	}
+	return pubs, rows.Err()
+}
+
+func (m *MySQLStore) Feeds(ctx context.Context,
+	userIds []int64, limit int) (map[int64][]Publication, error) {
+	feeds := make(map[int64][]Publication, len(userIds))
+	if len(userIds) == 0 {
+		return feeds, nil
+	}
+	args := make([]interface{}, len(userIds), len(userIds)+1)
+	for idx, userId := range userIds {
+		args[idx] = userId
+	}
+	args = append(args, limit-1)
+	// every followee gives no more than its newest limit publications
+	rows, err := m.db.QueryContext(ctx,
+		`SELECT f.followerId, p.id, p.author, p.txt, p.createdAt FROM publications p
+		JOIN followers f ON f.userId = p.author
+		WHERE f.followerId IN (?`+strings.Repeat(`, ?`, len(userIds)-1)+`)
+		AND p.id >= COALESCE((SELECT l.id FROM publications l
+			WHERE l.author = f.userId ORDER BY l.id DESC LIMIT 1 OFFSET ?), 0)
+		ORDER BY f.followerId, p.id DESC;`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userId int64
+		var p Publication
+		err = rows.Scan(&userId, &p.Id, &p.Author, &p.Text, &p.At)
+		if err != nil {
+			return nil, err
+		}
+		if len(feeds[userId]) < limit {
+			feeds[userId] = append(feeds[userId], p)
+		}
+	}
+	return feeds, rows.Err()
+}
+
+func (m *MySQLStore) Recent(ctx context.Context, author int64, limit int) ([]Publication, error) {
+	rows, err := m.db.QueryContext(ctx,
+		`SELECT id, author, txt, createdAt FROM publications
+		WHERE author = ? ORDER BY id DESC LIMIT ?;`,
+		author, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pubs := make([]Publication, 0, limit)
+	for rows.Next() {
+		var p Publication
+		err = rows.Scan(&p.Id, &p.Author, &p.Text, &p.At)
+		if err != nil {
+			return nil, err
+		}
+		pubs = append(pubs, p)
+	}
+	return pubs, rows.Err()
+}
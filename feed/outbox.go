@@ -0,0 +1,96 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const outboxRelayKey = "outboxRelay"
+
+var errRelayLockLost = errors.New("outbox relay lock is lost")
+
+// RelayOutbox sends the stored publications to the fan-out queue in the
+// order of adding and marks them sent. A publication could be sent again
+// when marking fails, so the fan-out receives it at least once.
+func (s *Service) RelayOutbox() {
+	ticker := time.NewTicker(s.cfg.Outbox.Interval)
+	defer ticker.Stop()
+	for {
+		err := s.relayOutbox(s.ctx)
+		if err != nil {
+			log.Println(err.Error())
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.relay:
+		}
+		// the wake up could be picked after the cancellation
+		if s.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (s *Service) relayOutbox(ctx context.Context) error {
+	// a single instance relays the outbox at a time
+	token := uuid.NewString()
+	ttl := s.relayLockTTL()
+	locked, err := s.cache.Lock(ctx, outboxRelayKey, token, ttl)
+	if err != nil || !locked {
+		return err
+	}
+	defer s.cache.Unlock(context.Background(), outboxRelayKey, token)
+	for {
+		entries, err := s.outbox.PendingOutbox(ctx, s.cfg.Outbox.BatchSize)
+		if err != nil {
+			return err
+		}
+		sent := make([]int64, 0, len(entries))
+		var sendErr error
+		for _, entry := range entries {
+			// the lock outlives sending the entry or another instance took it
+			locked, sendErr = s.cache.Extend(ctx, outboxRelayKey, token, ttl)
+			if sendErr == nil && !locked {
+				sendErr = errRelayLockLost
+			}
+			if sendErr != nil {
+				break
+			}
+			sendErr = s.sendToQueue(ctx, entry.Body)
+			if sendErr != nil {
+				// the rest is sent in order on the next check
+				break
+			}
+			sent = append(sent, entry.Id)
+		}
+		err = s.outbox.MarkSent(ctx, sent)
+		if err != nil {
+			return err
+		}
+		if sendErr != nil || len(entries) < s.cfg.Outbox.BatchSize {
+			return sendErr
+		}
+	}
+}
+
+// relayLockTTL covers sending a single entry with all its retries.
+func (s *Service) relayLockTTL() time.Duration {
+	retries := time.Duration(s.cfg.RabbitMQ.PublishRetries)
+	return s.cfg.Outbox.Interval +
+		(retries+1)*s.cfg.Timeouts.Publish +
+		retries*(retries+1)/2*s.cfg.RabbitMQ.PublishRetryBackoff
+}
+
+// wakeRelay lets the relay send a new publication without waiting.
+func (s *Service) wakeRelay() {
+	select {
+	case s.relay <- struct{}{}:
+	default:
+	}
+}
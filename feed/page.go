@@ -0,0 +1,181 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FeedPage is a page of the feed, newest publications first.
+type FeedPage struct {
+	Publications []Publication `json:"publications"`
+	// Next points to the older publications.
+	Next string `json:"next,omitempty"`
+	// Prev points to the newer publications.
+	Prev string `json:"prev,omitempty"`
+}
+
+// Cursor is a position in the feed given by a publication id or time.
+// The zero Cursor points to the top of the feed.
+type Cursor struct {
+	// After selects the publications newer than the position,
+	// otherwise the older ones are selected.
+	After bool
+	Id    int64
+	At    time.Time
+}
+
+// ParseCursor accepts "before:<position>" and "after:<position>", where
+// the position is a publication id or an RFC 3339 time. A position
+// without the prefix points before it.
+func ParseCursor(s string) (Cursor, error) {
+	var c Cursor
+	position := s
+	if strings.HasPrefix(s, "after:") {
+		c.After = true
+		position = strings.TrimPrefix(s, "after:")
+	} else {
+		position = strings.TrimPrefix(s, "before:")
+	}
+	id, err := strconv.ParseInt(position, 10, 64)
+	if err == nil && id > 0 {
+		c.Id = id
+		return c, nil
+	}
+	at, err := time.Parse(time.RFC3339Nano, position)
+	if err == nil {
+		c.At = at
+		return c, nil
+	}
+	return c, fmt.Errorf("invalid cursor %q", s)
+}
+
+func (c Cursor) String() string {
+	direction := "before:"
+	if c.After {
+		direction = "after:"
+	}
+	if c.Id > 0 {
+		return direction + strconv.FormatInt(c.Id, 10)
+	}
+	if !c.At.IsZero() {
+		return direction + c.At.Format(time.RFC3339Nano)
+	}
+	return ""
+}
+
+func (c Cursor) IsZero() bool {
+	return c.Id == 0 && c.At.IsZero()
+}
+
+// Admits reports whether the publication is beyond the cursor
+// in the cursor's direction.
+func (c Cursor) Admits(p *Publication) bool {
+	switch {
+	case c.Id > 0 && c.After:
+		return p.Id > c.Id
+	case c.Id > 0:
+		return p.Id < c.Id
+	case c.At.IsZero():
+		return true
+	case c.After:
+		return p.At.After(c.At)
+	default:
+		return p.At.Before(c.At)
+	}
+}
+
+// feedPage reads the page from the cached feed and falls back
+// to the publication store when the cursor goes past the cache.
+func (s *Service) feedPage(ctx context.Context, userId int64,
+	cursor Cursor, limit int) (*FeedPage, error) {
+	view, err := s.openFeed(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	pubs, exhausted, err := s.cachedPage(view, cursor, limit)
+	if err != nil {
+		return nil, err
+	}
+	if exhausted {
+		if cursor.After {
+			// the cursor is older than the cache
+			pubs, err = s.publications.Feed(ctx, userId, cursor, limit)
+		} else if len(pubs) < limit {
+			rest := cursor
+			if len(pubs) > 0 {
+				rest = Cursor{Id: pubs[len(pubs)-1].Id}
+			}
+			var older []Publication
+			older, err = s.publications.Feed(ctx, userId, rest, limit-len(pubs))
+			pubs = append(pubs, older...)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	page := &FeedPage{Publications: pubs}
+	if len(pubs) == 0 {
+		if !cursor.IsZero() {
+			cursor.After = true
+			page.Prev = cursor.String()
+		}
+		return page, nil
+	}
+	if len(pubs) == limit || cursor.After {
+		page.Next = Cursor{Id: pubs[len(pubs)-1].Id}.String()
+	}
+	page.Prev = Cursor{After: true, Id: pubs[0].Id}.String()
+	return page, nil
+}
+
+// cachedPage scans the cached feed in chunks, exhausted reports whether
+// the page could continue past the end of the cache.
+func (s *Service) cachedPage(view feedView,
+	cursor Cursor, limit int) (pubs []Publication, exhausted bool, err error) {
+	pubs = make([]Publication, 0, limit)
+	chunk := int64(limit)
+	for start := int64(0); start <= s.cfg.Feed.MaxSize; start += chunk {
+		var chunkPubs []Publication
+		chunkPubs, err = view(start, start+chunk-1)
+		if err != nil {
+			return
+		}
+		for idx := range chunkPubs {
+			p := &chunkPubs[idx]
+			if !cursor.Admits(p) {
+				if cursor.After {
+					// the rest of the feed is older than the cursor
+					return closest(pubs, limit), false, nil
+				}
+				continue
+			}
+			pubs = append(pubs, *p)
+			if !cursor.After && len(pubs) == limit {
+				return
+			}
+		}
+		if int64(len(chunkPubs)) < chunk {
+			break
+		}
+	}
+	return closest(pubs, limit), true, nil
+}
+
+// closest keeps the last limit publications,
+// i.e. the ones next to an after cursor.
+func closest(pubs []Publication, limit int) []Publication {
+	if len(pubs) > limit {
+		return pubs[len(pubs)-limit:]
+	}
+	return pubs
+}
+
+func reverse(pubs []Publication) {
+	for i, j := 0, len(pubs)-1; i < j; i, j = i+1, j-1 {
+		pubs[i], pubs[j] = pubs[j], pubs[i]
+	}
+}
@@ -0,0 +1,118 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// PollFeed returns the publications of the user's feed newer than since
+// at once, otherwise it waits for the next one fanned out to the user
+// until the timeout and responds with no content. Without since only
+// the next publication is awaited.
+func (s *Service) PollFeed(c echo.Context) (err error) {
+	userId := c.Param("userId")
+	id, err := feedOwner(c)
+	if err != nil {
+		return
+	}
+	since, err := parseSince(c.QueryParam("since"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	timeout, err := s.pollTimeout(c.QueryParam("timeout"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	// the publications fanned out while reading the feed wait in the hub
+	conn, err := s.subscribeLive(c.Request().Context(), id, []string{userTopic(userId)})
+	if errors.Is(err, ErrDisconnected) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+	if err != nil {
+		return
+	}
+	defer s.hub.unsubscribe(context.Background(), conn)
+	if since >= 0 {
+		publications, err := s.newerPublications(s.ctx, id, since)
+		if err != nil {
+			return err
+		}
+		if len(publications) > 0 {
+			return c.JSON(http.StatusOK, publications)
+		}
+	}
+
+	// the live updates received while reading the feed come first
+	backlog := s.hub.replayed(conn)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		var body []byte
+		if len(backlog) > 0 {
+			body, backlog = backlog[0], backlog[1:]
+		} else {
+			var ok bool
+			select {
+			case <-c.Request().Context().Done():
+				return nil
+			case <-timer.C:
+				return c.NoContent(http.StatusNoContent)
+			case body, ok = <-conn.out:
+				if !ok {
+					return echo.NewHTTPError(http.StatusServiceUnavailable,
+						"live updates are unavailable")
+				}
+			}
+		}
+		f := new(Frame)
+		if json.Unmarshal(body, f) != nil {
+			continue
+		}
+		internal, err := s.followLive(conn, f)
+		if err != nil {
+			return err
+		}
+		if internal {
+			continue
+		}
+		p, ok := livePublication(f)
+		if ok && p.Id > since {
+			return c.JSON(http.StatusOK, []Publication{*p})
+		}
+	}
+}
+
+// pollTimeout parses the wait in seconds, the empty one is the default.
+func (s *Service) pollTimeout(param string) (time.Duration, error) {
+	if param == "" {
+		return s.cfg.Poll.Timeout, nil
+	}
+	seconds, err := strconv.Atoi(param)
+	timeout := time.Duration(seconds) * time.Second
+	if err != nil || seconds <= 0 || timeout > s.cfg.Poll.MaxTimeout {
+		return 0, fmt.Errorf("timeout should be between 1 and %d seconds",
+			s.cfg.Poll.MaxTimeout/time.Second)
+	}
+	return timeout, nil
+}
+
+// livePublication returns the publication of a live update frame,
+// the other frames of the user are skipped.
+func livePublication(f *Frame) (*Publication, bool) {
+	if f.Type != FramePublication {
+		return nil, false
+	}
+	p := new(Publication)
+	err := json.Unmarshal(f.Payload, p)
+	if err != nil {
+		return nil, false
+	}
+	return p, true
+}
@@ -0,0 +1,156 @@
+package feed
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/websocket"
+)
+
+// ProtocolV1 is the websocket subprotocol of the typed frames described
+// in PROTOCOL.md. A websocket without it gets the bare publications and
+// announcements, and its messages are only heartbeats.
+const ProtocolV1 = "feed.v1"
+
+// The frame types sent by the server, FrameEdit and FrameDeletion
+// are reserved until the publications can be edited and deleted.
+const (
+	FrameHello        = "hello"
+	FramePublication  = "publication"
+	FrameEdit         = "edit"
+	FrameDeletion     = "deletion"
+	FrameUnfollow     = "unfollow"
+	FrameAnnouncement = "announcement"
+	FramePresence     = "presence"
+	FramePage         = "page"
+	FrameOk           = "ok"
+	FrameError        = "error"
+)
+
+// frameCelebrity goes only through the broker, it subscribes the live
+// connections of the user to the publications of a followed celebrity.
+const frameCelebrity = "celebrity"
+
+// The frame types sent by the client, FramePage and FramePresence
+// are the commands too.
+const (
+	FrameAck       = "ack"
+	FrameSubscribe = "subscribe"
+	FrameHeartbeat = "heartbeat"
+)
+
+// Frame is a message of ProtocolV1. The live updates go through
+// the broker as frames without an id.
+type Frame struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// Id is set by the client on a command and repeated in the reply.
+	Id string `json:"id,omitempty"`
+}
+
+type Hello struct {
+	Version int `json:"version"`
+}
+
+// Deletion is the payload of FrameDeletion, FrameEdit carries
+// the edited Publication.
+type Deletion struct {
+	Id     int64 `json:"id"`
+	Author int64 `json:"author"`
+}
+
+// Unfollow tells the follower to drop the author's publications.
+type Unfollow struct {
+	Author int64 `json:"author"`
+}
+
+// celebrity is the payload of frameCelebrity.
+type celebrity struct {
+	Author int64 `json:"author"`
+}
+
+type Presence struct {
+	UserId int64  `json:"userId"`
+	Status string `json:"status"`
+}
+
+// Ack confirms the publications up to the id were shown.
+type Ack struct {
+	Id int64 `json:"id"`
+}
+
+type PageRequest struct {
+	Cursor string `json:"cursor"`
+	Limit  int    `json:"limit"`
+}
+
+type ErrorPayload struct {
+	Message string `json:"message"`
+}
+
+var presenceStatuses = map[string]bool{
+	"online": true,
+	"away":   true,
+	"typing": true,
+}
+
+// newFrame serializes the frame with the payload.
+func newFrame(typ string, payload interface{}) ([]byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Frame{Type: typ, Payload: body})
+}
+
+// legacyMessage returns the bare payload of a publication or
+// an announcement, the other frames are not sent to the legacy websockets.
+func legacyMessage(f *Frame) ([]byte, bool) {
+	switch f.Type {
+	case FramePublication, FrameAnnouncement:
+		return f.Payload, true
+	}
+	return nil, false
+}
+
+// handshakeWebsocket checks the origin like websocket.Handler does
+// and picks ProtocolV1 when the client offers it.
+func handshakeWebsocket(config *websocket.Config, req *http.Request) (err error) {
+	config.Origin, err = websocket.Origin(config, req)
+	if err == nil && config.Origin == nil {
+		return errors.New("null origin")
+	}
+	if err != nil {
+		return err
+	}
+	for _, protocol := range config.Protocol {
+		if protocol == ProtocolV1 {
+			config.Protocol = []string{ProtocolV1}
+			return nil
+		}
+	}
+	// the legacy clients get the first protocol they offer
+	if len(config.Protocol) > 1 {
+		config.Protocol = config.Protocol[:1]
+	}
+	return nil
+}
+
+func isProtocolV1(ws *websocket.Conn) bool {
+	protocols := ws.Config().Protocol
+	return len(protocols) == 1 && protocols[0] == ProtocolV1
+}
+
+// decodePayload unmarshals the payload of the client's command.
+func decodePayload(f *Frame, payload interface{}) error {
+	if len(f.Payload) == 0 {
+		return fmt.Errorf("%s has no payload", f.Type)
+	}
+	err := json.Unmarshal(f.Payload, payload)
+	if err != nil {
+		return fmt.Errorf("invalid %s payload: %v", f.Type, err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+)
+
+// feedView returns the publications of a feed
+// between start and stop inclusive, newest first.
+type feedView func(start, stop int64) ([]Publication, error)
+
+// isCelebrity reports whether the author's publications are pulled
+// into the feeds of the followers instead of being pushed to them.
+func (s *Service) isCelebrity(ctx context.Context, author int64) (bool, error) {
+	if s.cfg.Feed.CelebrityThreshold <= 0 {
+		return false, nil
+	}
+	count, err := s.cache.FollowerCount(ctx, author)
+	return count > s.cfg.Feed.CelebrityThreshold, err
+}
+
+// celebrityPatterns returns the author patterns of the celebrities followed
+// by the user, their publications never reach the user's topic.
+func (s *Service) celebrityPatterns(ctx context.Context, userId int64) ([]string, error) {
+	followees, err := s.cache.Followees(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	celebrities, err := s.cache.Celebrities(ctx, followees)
+	if err != nil {
+		return nil, err
+	}
+	patterns := make([]string, len(celebrities))
+	for idx, celebrity := range celebrities {
+		patterns[idx] = authorPattern(celebrity)
+	}
+	return patterns, nil
+}
+
+// subscribeLive subscribes the live connection of the user to the topics
+// and to the publications of the followed celebrities.
+func (s *Service) subscribeLive(ctx context.Context,
+	userId int64, topics []string) (*hubConn, error) {
+	celebrities, err := s.celebrityPatterns(s.ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.hub.subscribe(ctx, topics)
+	if err != nil {
+		return nil, err
+	}
+	err = s.hub.follow(ctx, conn, celebrities)
+	if err != nil {
+		s.hub.unsubscribe(context.Background(), conn)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// followCelebrity subscribes the live connections of the follower
+// to the followed author if it is a celebrity.
+func (s *Service) followCelebrity(ctx context.Context, f *Follower) error {
+	celebrities, err := s.cache.Celebrities(ctx, []int64{f.UserId})
+	if err != nil || len(celebrities) == 0 {
+		return err
+	}
+	return s.sendToUser(strconv.FormatInt(f.FollowerId, 10),
+		frameCelebrity, celebrity{Author: f.UserId})
+}
+
+// followLive keeps the live connection subscribed to the celebrities
+// followed by the user and reports whether the frame is only meant
+// for the connection.
+func (s *Service) followLive(conn *hubConn, f *Frame) (bool, error) {
+	switch f.Type {
+	case frameCelebrity:
+		c := new(celebrity)
+		err := json.Unmarshal(f.Payload, c)
+		if err != nil {
+			return true, err
+		}
+		return true, s.hub.follow(s.ctx, conn, []string{authorPattern(c.Author)})
+	case FrameUnfollow:
+		u := new(Unfollow)
+		err := json.Unmarshal(f.Payload, u)
+		if err != nil {
+			return false, err
+		}
+		s.hub.unfollow(s.ctx, conn, authorPattern(u.Author))
+	}
+	return false, nil
+}
+
+// openFeed merges the pushed feed of the user with the publications
+// pulled from the followed celebrities. The workers fan out the authors
+// in parallel, so the pushed feed is sorted newest first on reading.
+func (s *Service) openFeed(ctx context.Context, userId int64) (feedView, error) {
+	items, err := s.cache.Feed(ctx, strconv.FormatInt(userId, 10), 0, s.cfg.Feed.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	merged, err := decodeFeed(items)
+	if err != nil {
+		return nil, err
+	}
+	sortFeed(merged)
+	if s.cfg.Feed.CelebrityThreshold > 0 {
+		merged, err = s.pullCelebrities(ctx, userId, merged)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return func(start, stop int64) ([]Publication, error) {
+		if start >= int64(len(merged)) {
+			return nil, nil
+		}
+		if stop >= int64(len(merged)) {
+			stop = int64(len(merged)) - 1
+		}
+		return merged[start : stop+1], nil
+	}, nil
+}
+
+func (s *Service) pullCelebrities(ctx context.Context,
+	userId int64, merged []Publication) ([]Publication, error) {
+	followees, err := s.cache.Followees(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	celebrities, err := s.cache.Celebrities(ctx, followees)
+	if err != nil || len(celebrities) == 0 {
+		return merged, err
+	}
+	pulled, err := s.cache.AuthorFeeds(ctx, celebrities, s.cfg.Feed.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	for _, items := range pulled {
+		pubs, err := decodeFeed(items)
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeFeeds(merged, pubs)
+	}
+	if int64(len(merged)) > s.cfg.Feed.MaxSize+1 {
+		merged = merged[:s.cfg.Feed.MaxSize+1]
+	}
+	return merged, nil
+}
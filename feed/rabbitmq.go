@@ -0,0 +1,660 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	// ErrNotConfirmed is returned when the broker rejects a publication.
+	ErrNotConfirmed = errors.New("publication is not confirmed by the broker")
+	// ErrDisconnected is returned while the broker is reconnecting.
+	ErrDisconnected = errors.New("broker is disconnected")
+)
+
+// RabbitBroker carries publications over RabbitMQ. It redials the lost
+// connection, declares the topology again and resumes the consumers.
+//
+// A channel is used by one goroutine at a time: the publishers take
+// channels from a pool, every consumer has its own channel and the queues
+// are declared on the admin channel under its lock.
+//
+// The live updates of the process go to its exclusive queue, which is
+// declared again with its bindings after a reconnect.
+type RabbitBroker struct {
+	cfg        RabbitMQConfig
+	mu         sync.RWMutex
+	conn       *amqp.Connection
+	state      BrokerState
+	ready      chan struct{} // closed while connected
+	closing    chan struct{}
+	adminMu    sync.Mutex
+	admin      *amqp.Channel
+	publishers chan *amqp.Channel
+	liveQueue  string
+	bindings   map[string]bool // guarded by adminMu
+	consumers  map[*consumer]struct{}
+}
+
+// consumer keeps consuming the queue on its own channel across
+// reconnects until it is stopped.
+type consumer struct {
+	queue    string
+	declare  func(ch *amqp.Channel) error
+	ch       *amqp.Channel
+	out      chan Delivery
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// stop ends the consumer's goroutine, the deliveries not taken
+// are requeued when its channel closes.
+func (c *consumer) stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopped)
+	})
+}
+
+func NewRabbitBroker(cfg RabbitMQConfig) (*RabbitBroker, error) {
+	b := &RabbitBroker{
+		cfg:        cfg,
+		state:      BrokerReconnecting,
+		ready:      make(chan struct{}),
+		closing:    make(chan struct{}),
+		publishers: make(chan *amqp.Channel, cfg.PublishChannels),
+		liveQueue:  "live." + uuid.NewString(),
+		bindings:   make(map[string]bool),
+		consumers:  make(map[*consumer]struct{}),
+	}
+	// the channels are opened on demand
+	for i := 0; i < cfg.PublishChannels; i++ {
+		b.publishers <- nil
+	}
+	conn, err := amqp.Dial(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	err = b.open(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go b.watch()
+	return b, nil
+}
+
+func (b *RabbitBroker) Publish(ctx context.Context, body []byte) error {
+	ch, err := b.publisher(ctx)
+	if err != nil {
+		return err
+	}
+	defer b.release(ch)
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx,
+		"",          // exchange
+		b.cfg.Queue, // routing key
+		false,       // mandatory
+		false,       // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+		})
+	if err != nil {
+		return err
+	}
+	return waitConfirm(ctx, confirm)
+}
+
+// waitConfirm waits until the broker stores the publication,
+// the pending confirmations are rejected when the channel closes.
+func waitConfirm(ctx context.Context, confirm *amqp.DeferredConfirmation) error {
+	acked := make(chan bool, 1)
+	go func() {
+		acked <- confirm.Wait()
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case ok := <-acked:
+		if !ok {
+			return ErrNotConfirmed
+		}
+		return nil
+	}
+}
+
+func (b *RabbitBroker) PublishTopic(ctx context.Context, topic string, body []byte) error {
+	ch, err := b.publisher(ctx)
+	if err != nil {
+		return err
+	}
+	defer b.release(ch)
+	return ch.PublishWithContext(ctx,
+		b.cfg.Exchange, // exchange
+		topic,          // routing key
+		false,          // mandatory
+		false,          // immediate
+		amqp.Publishing{
+			ContentType: "application/json",
+			Body:        body,
+		})
+}
+
+func (b *RabbitBroker) Consume() (<-chan Delivery, error) {
+	// the fan-out queue is declared with the topology
+	return b.startConsumer(&consumer{queue: b.cfg.Queue})
+}
+
+func (b *RabbitBroker) Listen() (<-chan Delivery, error) {
+	c := &consumer{queue: b.liveQueue}
+	// the queue is deleted with the connection and
+	// declared again with the bindings by the resumed consumer
+	c.declare = func(ch *amqp.Channel) error {
+		err := b.declareLive(ch)
+		if err != nil {
+			return err
+		}
+		for pattern := range b.bindings {
+			err = b.bindLive(ch, pattern)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return b.startConsumer(c)
+}
+
+func (b *RabbitBroker) Bind(ctx context.Context, pattern string) error {
+	return b.withAdmin(func(ch *amqp.Channel) error {
+		// the queue could be not declared again yet after a reconnect
+		err := b.declareLive(ch)
+		if err == nil {
+			err = b.bindLive(ch, pattern)
+		}
+		if err != nil {
+			return err
+		}
+		b.bindings[pattern] = true
+		return nil
+	})
+}
+
+func (b *RabbitBroker) Unbind(ctx context.Context, pattern string) error {
+	b.adminMu.Lock()
+	delete(b.bindings, pattern)
+	b.adminMu.Unlock()
+	err := b.withAdmin(func(ch *amqp.Channel) error {
+		return ch.QueueUnbind(
+			b.liveQueue,    // name
+			pattern,        // key
+			b.cfg.Exchange, // exchange
+			nil,            // args
+		)
+	})
+	if errors.Is(err, ErrDisconnected) {
+		// the queue is declared again without the binding
+		return nil
+	}
+	return err
+}
+
+func (b *RabbitBroker) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	// the unacknowledged messages return to the queue on closing the channel
+	ch, err := b.openChannel()
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Close()
+	var deadLetters []DeadLetter
+	for ctx.Err() == nil {
+		msg, ok, err := ch.Get(b.cfg.DeadLetterQueue, false)
+		if err != nil || !ok {
+			return deadLetters, err
+		}
+		deadLetters = append(deadLetters, deadLetter(msg))
+	}
+	return deadLetters, ctx.Err()
+}
+
+func (b *RabbitBroker) ReplayDeadLetters(ctx context.Context) (int, error) {
+	ch, err := b.openChannel()
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+	// a dead letter is removed only after its copy is stored
+	err = ch.Confirm(false)
+	if err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for ctx.Err() == nil {
+		msg, ok, err := ch.Get(b.cfg.DeadLetterQueue, false)
+		if err != nil || !ok {
+			return replayed, err
+		}
+		confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx,
+			"",          // exchange
+			b.cfg.Queue, // routing key
+			false,       // mandatory
+			false,       // immediate
+			amqp.Publishing{
+				ContentType:  msg.ContentType,
+				DeliveryMode: amqp.Persistent,
+				Body:         msg.Body,
+			})
+		if err == nil {
+			err = waitConfirm(ctx, confirm)
+		}
+		if err != nil {
+			return replayed, err
+		}
+		err = msg.Ack(false)
+		if err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, ctx.Err()
+}
+
+func (b *RabbitBroker) State() BrokerState {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.state
+}
+
+func (b *RabbitBroker) Close() error {
+	b.mu.Lock()
+	if b.state == BrokerClosed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.state = BrokerClosed
+	close(b.closing)
+	conn := b.conn
+	for c := range b.consumers {
+		c.stop()
+	}
+	b.mu.Unlock()
+	// closing the connection closes all its channels
+	return conn.Close()
+}
+
+// publisher takes a channel in confirm mode from the pool,
+// it is returned by release.
+func (b *RabbitBroker) publisher(ctx context.Context) (*amqp.Channel, error) {
+	var ch *amqp.Channel
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case ch = <-b.publishers:
+	}
+	if ch != nil && !ch.IsClosed() {
+		return ch, nil
+	}
+	// the channel was not opened yet or closed with its connection
+	ch, err := b.openChannel()
+	if err == nil {
+		err = ch.Confirm(false)
+	}
+	if err != nil {
+		if ch != nil {
+			ch.Close()
+		}
+		b.publishers <- nil
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (b *RabbitBroker) release(ch *amqp.Channel) {
+	b.publishers <- ch
+}
+
+// withAdmin runs the declarations on the admin channel.
+func (b *RabbitBroker) withAdmin(declare func(ch *amqp.Channel) error) error {
+	b.mu.RLock()
+	state := b.state
+	b.mu.RUnlock()
+	switch state {
+	case BrokerClosed:
+		return amqp.ErrClosed
+	case BrokerReconnecting:
+		return ErrDisconnected
+	}
+	b.adminMu.Lock()
+	defer b.adminMu.Unlock()
+	return declare(b.admin)
+}
+
+func (b *RabbitBroker) declareLive(ch *amqp.Channel) error {
+	_, err := ch.QueueDeclare(
+		b.liveQueue, // name
+		false,       // durable
+		false,       // delete when unused
+		true,        // exclusive
+		false,       // no-wait
+		nil,         // arguments
+	)
+	return err
+}
+
+func (b *RabbitBroker) bindLive(ch *amqp.Channel, pattern string) error {
+	return ch.QueueBind(
+		b.liveQueue,    // name
+		pattern,        // key
+		b.cfg.Exchange, // exchange
+		false,          // noWait
+		nil,            // args
+	)
+}
+
+// openChannel opens a separate channel of the connection.
+func (b *RabbitBroker) openChannel() (*amqp.Channel, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	switch b.state {
+	case BrokerConnected:
+		return b.conn.Channel()
+	case BrokerClosed:
+		return nil, amqp.ErrClosed
+	}
+	return nil, ErrDisconnected
+}
+
+// open declares the topology on a new admin channel of the connection.
+func (b *RabbitBroker) open(conn *amqp.Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	err = declareTopology(ch, b.cfg)
+	if err != nil {
+		ch.Close()
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BrokerClosed {
+		ch.Close()
+		return amqp.ErrClosed
+	}
+	b.adminMu.Lock()
+	b.admin = ch
+	b.adminMu.Unlock()
+	b.conn = conn
+	b.state = BrokerConnected
+	close(b.ready)
+	return nil
+}
+
+// watch reconnects when the connection or the channel closes.
+func (b *RabbitBroker) watch() {
+	for {
+		b.mu.RLock()
+		conn := b.conn
+		b.mu.RUnlock()
+		b.adminMu.Lock()
+		ch := b.admin
+		b.adminMu.Unlock()
+		connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+		select {
+		case <-b.closing:
+			return
+		case err := <-connClosed:
+			log.Printf("RabbitMQ connection closed: %v", err)
+		case err := <-chClosed:
+			log.Printf("RabbitMQ admin channel closed: %v", err)
+		}
+		b.mu.Lock()
+		if b.state == BrokerClosed {
+			b.mu.Unlock()
+			return
+		}
+		b.state = BrokerReconnecting
+		b.ready = make(chan struct{})
+		b.mu.Unlock()
+		ch.Close()
+		if !b.reconnect(conn) {
+			return
+		}
+	}
+}
+
+// reconnect redials with exponential backoff, the connection is kept
+// when only the channel was closed. It reports false once closed.
+func (b *RabbitBroker) reconnect(conn *amqp.Connection) bool {
+	backoff := b.cfg.RedialBackoff
+	for {
+		select {
+		case <-b.closing:
+			conn.Close()
+			return false
+		case <-time.After(backoff):
+		}
+		var err error
+		if conn.IsClosed() {
+			conn, err = amqp.Dial(b.cfg.URL)
+		}
+		if err == nil {
+			err = b.open(conn)
+			if err == nil {
+				log.Print("RabbitMQ reconnected")
+				return true
+			}
+			if errors.Is(err, amqp.ErrClosed) && b.State() == BrokerClosed {
+				conn.Close()
+				return false
+			}
+		}
+		log.Printf("RabbitMQ reconnect failed, retrying in %s: %v", backoff, err)
+		backoff *= 2
+		if backoff > b.cfg.MaxRedialBackoff {
+			backoff = b.cfg.MaxRedialBackoff
+		}
+	}
+}
+
+// startConsumer consumes the queue and resumes consuming
+// after every reconnect until the consumer is stopped.
+func (b *RabbitBroker) startConsumer(c *consumer) (<-chan Delivery, error) {
+	c.out = make(chan Delivery)
+	c.stopped = make(chan struct{})
+	msgs, err := b.consume(c)
+	if err == nil {
+		// the consumer is stopped when the broker closes
+		b.mu.Lock()
+		if b.state == BrokerClosed {
+			err = amqp.ErrClosed
+		} else {
+			b.consumers[c] = struct{}{}
+		}
+		b.mu.Unlock()
+	}
+	if err != nil {
+		if c.ch != nil {
+			c.ch.Close()
+		}
+		return nil, err
+	}
+	go func() {
+		defer close(c.out)
+		defer func() {
+			c.ch.Close()
+			c.stop()
+			b.mu.Lock()
+			delete(b.consumers, c)
+			b.mu.Unlock()
+		}()
+		for {
+			for msg := range msgs {
+				select {
+				case c.out <- delivery(msg):
+				case <-c.stopped:
+					return
+				}
+			}
+			// the consumer is cancelled or the channel is closed
+			msgs, err = b.resume(c)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return c.out, nil
+}
+
+// resume consumes the queue again once the broker is connected.
+func (b *RabbitBroker) resume(c *consumer) (<-chan amqp.Delivery, error) {
+	for {
+		b.mu.RLock()
+		ready := b.ready
+		b.mu.RUnlock()
+		select {
+		case <-c.stopped:
+			return nil, amqp.ErrClosed
+		case <-b.closing:
+			return nil, amqp.ErrClosed
+		case <-ready:
+		}
+		msgs, err := b.consume(c)
+		if err == nil {
+			return msgs, nil
+		}
+		log.Printf("RabbitMQ consumer of %s: %v", c.queue, err)
+		select {
+		case <-c.stopped:
+		case <-time.After(b.cfg.RedialBackoff):
+		}
+	}
+}
+
+// consume opens a new channel of the consumer.
+func (b *RabbitBroker) consume(c *consumer) (<-chan amqp.Delivery, error) {
+	if c.declare != nil {
+		err := b.withAdmin(c.declare)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.ch != nil {
+		c.ch.Close()
+	}
+	ch, err := b.openChannel()
+	if err != nil {
+		return nil, err
+	}
+	c.ch = ch
+	// limit the publications delivered ahead of the acknowledgements
+	err = ch.Qos(
+		b.cfg.Prefetch, // prefetch count
+		0,              // prefetch size
+		false,          // global
+	)
+	if err != nil {
+		return nil, err
+	}
+	// the channel is closed by the consumer
+	return ch.Consume(
+		c.queue, // queue
+		"",      // consumer
+		false,   // auto-ack
+		false,   // exclusive
+		false,   // no-local
+		false,   // no-wait
+		nil,     // args
+	)
+}
+
+func declareTopology(ch *amqp.Channel, cfg RabbitMQConfig) error {
+	// the rejected publications are kept in the dead-letter queue
+	err := ch.ExchangeDeclare(
+		cfg.DeadLetterExchange, // name
+		"fanout",               // kind
+		true,                   // durable
+		false,                  // autoDelete
+		false,                  // internal
+		false,                  // noWait
+		nil,                    // args
+	)
+	if err != nil {
+		return err
+	}
+	_, err = ch.QueueDeclare(
+		cfg.DeadLetterQueue, // name
+		true,                // durable
+		false,               // delete when unused
+		false,               // exclusive
+		false,               // no-wait
+		nil,                 // arguments
+	)
+	if err != nil {
+		return err
+	}
+	err = ch.QueueBind(
+		cfg.DeadLetterQueue,    // name
+		"",                     // key
+		cfg.DeadLetterExchange, // exchange
+		false,                  // noWait
+		nil,                    // args
+	)
+	if err != nil {
+		return err
+	}
+	_, err = ch.QueueDeclare(
+		cfg.Queue, // name
+		true,      // durable
+		false,     // delete when unused
+		false,     // exclusive
+		false,     // no-wait
+		amqp.Table{"x-dead-letter-exchange": cfg.DeadLetterExchange},
+	)
+	if err != nil {
+		return err
+	}
+	return ch.ExchangeDeclare(
+		cfg.Exchange, // name
+		"topic",      // kind
+		true,         // durable
+		false,        // autoDelete
+		false,        // internal
+		false,        // noWait
+		nil,          // args
+	)
+}
+
+func delivery(msg amqp.Delivery) Delivery {
+	return Delivery{
+		Topic: msg.RoutingKey,
+		Body:  msg.Body,
+		Ack: func() error {
+			return msg.Ack(false)
+		},
+		Nack: func(requeue bool) error {
+			return msg.Nack(false, requeue)
+		},
+	}
+}
+
+// deadLetter reads the latest death of the message from its headers.
+func deadLetter(msg amqp.Delivery) DeadLetter {
+	d := DeadLetter{Body: msg.Body}
+	deaths, _ := msg.Headers["x-death"].([]interface{})
+	if len(deaths) == 0 {
+		return d
+	}
+	death, _ := deaths[0].(amqp.Table)
+	d.Reason, _ = death["reason"].(string)
+	d.Count, _ = death["count"].(int64)
+	d.At, _ = death["time"].(time.Time)
+	return d
+}
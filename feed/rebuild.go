@@ -0,0 +1,255 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	warmBatchSize     = 100
+	rebuildCheckpoint = "rebuildCacheCheckpoint"
+)
+
+// rebuilds lets a single goroutine rebuild the feed of a user at a time.
+type rebuilds struct {
+	mu    sync.Mutex
+	calls map[int64]*rebuildCall
+}
+
+type rebuildCall struct {
+	done chan struct{}
+	err  error
+}
+
+// EnsureFeed rebuilds the cached feed from the publication store
+// when it is missing, e.g. after Redis was flushed.
+func (s *Service) EnsureFeed(ctx context.Context, userId int64) error {
+	key := strconv.FormatInt(userId, 10)
+	head, err := s.cache.Feed(ctx, key, 0, 0)
+	if err != nil || len(head) > 0 {
+		return err
+	}
+	// an empty feed is not loaded again until its marker expires
+	empty, err := s.cache.FeedEmpty(ctx, key)
+	if err != nil || empty {
+		return err
+	}
+	s.rebuilds.mu.Lock()
+	if call, ok := s.rebuilds.calls[userId]; ok {
+		// wait for the rebuild in progress
+		s.rebuilds.mu.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &rebuildCall{done: make(chan struct{})}
+	s.rebuilds.calls[userId] = call
+	s.rebuilds.mu.Unlock()
+
+	call.err = s.rebuildFeed(ctx, userId)
+
+	s.rebuilds.mu.Lock()
+	delete(s.rebuilds.calls, userId)
+	s.rebuilds.mu.Unlock()
+	close(call.done)
+	return call.err
+}
+
+func (s *Service) rebuildFeed(ctx context.Context, userId int64) error {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeouts.Rebuild)
+	defer cancel()
+	// other instances could rebuild the same feed
+	key := feedRebuildKey(userId)
+	token := uuid.NewString()
+	for {
+		locked, err := s.cache.Lock(ctx, key, token, s.cfg.Timeouts.Rebuild)
+		if err != nil {
+			return err
+		}
+		if locked {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	defer s.cache.Unlock(context.Background(), key, token)
+
+	_, err := s.cache.Fill(ctx, strconv.FormatInt(userId, 10), s.cfg.Feed.EmptyTTL,
+		func() ([]string, error) {
+			return s.loadFeed(ctx, userId)
+		})
+	return err
+}
+
+// loadFeed serializes the newest publications of the user's feed.
+func (s *Service) loadFeed(ctx context.Context, userId int64) ([]string, error) {
+	pubs, err := s.publications.Feed(ctx, userId,
+		Cursor{}, int(s.cfg.Feed.MaxSize)+1)
+	if err != nil {
+		return nil, err
+	}
+	return encodeFeed(pubs)
+}
+
+// loadFeeds serializes the newest publications of the users' feeds
+// loaded at once.
+func (s *Service) loadFeeds(ctx context.Context, userIds []int64) (map[string][]string, error) {
+	pubs, err := s.publications.Feeds(ctx, userIds, int(s.cfg.Feed.MaxSize)+1)
+	if err != nil {
+		return nil, err
+	}
+	feeds := make(map[string][]string, len(userIds))
+	for _, userId := range userIds {
+		feeds[strconv.FormatInt(userId, 10)], err = encodeFeed(pubs[userId])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return feeds, nil
+}
+
+// loadCelebrities serializes the newest publications of the celebrities
+// among the users by their followers, their feeds are pulled on reading.
+func (s *Service) loadCelebrities(ctx context.Context,
+	followers map[int64][]int64) (map[int64][]string, error) {
+	feeds := make(map[int64][]string)
+	if s.cfg.Feed.CelebrityThreshold <= 0 {
+		return feeds, nil
+	}
+	for userId, followerIds := range followers {
+		if int64(len(followerIds)) <= s.cfg.Feed.CelebrityThreshold {
+			continue
+		}
+		pubs, err := s.publications.Recent(ctx, userId, int(s.cfg.Feed.MaxSize)+1)
+		if err != nil {
+			return nil, err
+		}
+		feeds[userId], err = encodeFeed(pubs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return feeds, nil
+}
+
+// RebuildCache regenerates the followedBy and the follows sets and the feeds
+// of all users in batches. It continues after the last completed batch
+// of an interrupted run unless the config asks to restart.
+func (s *Service) RebuildCache(ctx context.Context) error {
+	afterId, err := s.cache.Checkpoint(ctx, rebuildCheckpoint)
+	if err != nil {
+		return err
+	}
+	if s.cfg.Rebuild.Restart {
+		afterId = 0
+	} else if afterId > 0 {
+		log.Printf("resuming cache rebuild after user %d", afterId)
+	}
+	started := time.Now()
+	rebuilt := 0
+	for {
+		userIds, err := s.users.UserIds(ctx, afterId, s.cfg.Rebuild.BatchSize)
+		if err != nil {
+			return err
+		}
+		if len(userIds) == 0 {
+			break
+		}
+		followers, err := s.followers.FollowerIds(ctx, userIds)
+		if err != nil {
+			return err
+		}
+		followees, err := s.followers.FolloweeIds(ctx, userIds)
+		if err != nil {
+			return err
+		}
+		for _, userId := range userIds {
+			// clear the stale followers and followees
+			if _, ok := followers[userId]; !ok {
+				followers[userId] = nil
+			}
+			if _, ok := followees[userId]; !ok {
+				followees[userId] = nil
+			}
+		}
+		feeds, err := s.loadFeeds(ctx, userIds)
+		if err != nil {
+			return err
+		}
+		celebrities, err := s.loadCelebrities(ctx, followers)
+		if err != nil {
+			return err
+		}
+		err = s.cache.ReplaceFollowers(ctx, followers, followees)
+		if err != nil {
+			return err
+		}
+		err = s.cache.ReplaceFeeds(ctx, feeds)
+		if err != nil {
+			return err
+		}
+		err = s.cache.ReplaceCelebrities(ctx, userIds, celebrities)
+		if err != nil {
+			return err
+		}
+		afterId = userIds[len(userIds)-1]
+		err = s.cache.SetCheckpoint(ctx, rebuildCheckpoint, afterId)
+		if err != nil {
+			return err
+		}
+		rebuilt += len(userIds)
+		log.Printf("rebuilt cache of %d users up to user %d in %s",
+			rebuilt, afterId, time.Since(started).Round(time.Millisecond))
+		if len(userIds) < s.cfg.Rebuild.BatchSize {
+			break
+		}
+	}
+	return s.cache.SetCheckpoint(ctx, rebuildCheckpoint, 0)
+}
+
+// WarmFeeds periodically rebuilds the missing feeds of the users following
+// someone, the feeds of the others are always empty.
+func (s *Service) WarmFeeds() {
+	if s.cfg.Feed.WarmInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.cfg.Feed.WarmInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var afterId int64
+		for {
+			userIds, err := s.followers.FollowingIds(s.ctx, afterId, warmBatchSize)
+			if err != nil {
+				log.Println(err.Error())
+				break
+			}
+			for _, userId := range userIds {
+				err = s.EnsureFeed(s.ctx, userId)
+				if err != nil {
+					log.Println(err.Error())
+				}
+			}
+			if len(userIds) < warmBatchSize {
+				break
+			}
+			afterId = userIds[len(userIds)-1]
+		}
+	}
+}
+
+func feedRebuildKey(userId int64) string {
+	return fmt.Sprintf("%dfeedRebuild", userId)
+}
@@ -0,0 +1,481 @@
+package feed
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// celebritiesKey is the set of authors whose publications
+// are pulled into the feeds instead of being pushed.
+const celebritiesKey = "celebrities"
+
+// pushScript prepends the publication ARGV[2] with the id ARGV[1] to the
+// list KEYS[1] unless the id is in the sorted set KEYS[2] of the list's ids.
+// Both keep the newest ARGV[3] + 1 publications. A missing list is created
+// when ARGV[4] is 1 or the list is marked empty by the key KEYS[3],
+// otherwise the script only remembers the id and leaves the list
+// to be rebuilt with the whole history.
+var pushScript = redis.NewScript(`
+if redis.call('ZADD', KEYS[2], 'NX', ARGV[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('ZREMRANGEBYRANK', KEYS[2], 0, -tonumber(ARGV[3]) - 2)
+if not redis.call('ZSCORE', KEYS[2], ARGV[1]) then
+	return 0
+end
+if ARGV[4] ~= '1' and redis.call('EXISTS', KEYS[1]) == 0 and
+	redis.call('DEL', KEYS[3]) == 0 then
+	return 2
+end
+redis.call('LPUSH', KEYS[1], ARGV[2])
+redis.call('LTRIM', KEYS[1], 0, ARGV[3])
+return 1
+`)
+
+// The results of pushing a publication to a feed.
+const (
+	// pushSkipped means the feed already got the publication.
+	pushSkipped int64 = iota
+	pushInserted
+	// pushMissing means the feed is not cached, it gets the publication
+	// when it is rebuilt.
+	pushMissing
+)
+
+// extendScript sets the ttl ARGV[2] in milliseconds
+// of the lock KEYS[1] if it is held by the token ARGV[1].
+var extendScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+`)
+
+// unlockScript deletes the lock KEYS[1] if it is held by the token ARGV[1].
+var unlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call('DEL', KEYS[1])
+`)
+
+// RedisCache keeps the followedBy sets and the feed lists in Redis.
+type RedisCache struct {
+	rdb         *redis.Client
+	feedMaxSize int64
+}
+
+func NewRedisCache(rdb *redis.Client, feedMaxSize int64) *RedisCache {
+	return &RedisCache{rdb, feedMaxSize}
+}
+
+func (r *RedisCache) AddFollower(ctx context.Context, userId, followerId int64) error {
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, followedSetKey(userId), followerId)
+		pipe.SAdd(ctx, followsSetKey(followerId), userId)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisCache) RemoveFollower(ctx context.Context, userId, followerId int64) error {
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SRem(ctx, followedSetKey(userId), followerId)
+		pipe.SRem(ctx, followsSetKey(followerId), userId)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisCache) Followers(ctx context.Context, userId int64) ([]string, error) {
+	return r.rdb.SMembers(ctx, followedSetKey(userId)).Result()
+}
+
+func (r *RedisCache) FollowerCount(ctx context.Context, userId int64) (int64, error) {
+	return r.rdb.SCard(ctx, followedSetKey(userId)).Result()
+}
+
+func (r *RedisCache) Followees(ctx context.Context, followerId int64) ([]int64, error) {
+	members, err := r.rdb.SMembers(ctx, followsSetKey(followerId)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseIds(members)
+}
+
+func (r *RedisCache) Feed(ctx context.Context, userId string, start, stop int64) ([]string, error) {
+	return r.rdb.LRange(ctx, userId, start, stop).Result()
+}
+
+func (r *RedisCache) PushMany(ctx context.Context,
+	userIds []string, id int64, pub string) (pushed, missing []string, err error) {
+	cmds, err := r.push(ctx, userIds, id, pub, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	for idx, cmd := range cmds {
+		switch cmd.Val() {
+		case pushInserted:
+			pushed = append(pushed, userIds[idx])
+		case pushMissing:
+			missing = append(missing, userIds[idx])
+		}
+	}
+	return pushed, missing, nil
+}
+
+// push runs pushScript for the feeds in a pipeline,
+// create lets it start the missing feeds.
+func (r *RedisCache) push(ctx context.Context,
+	keys []string, id int64, pub string, create bool) ([]*redis.Cmd, error) {
+	createArg := 0
+	if create {
+		createArg = 1
+	}
+	run := func() ([]*redis.Cmd, error) {
+		cmds := make([]*redis.Cmd, len(keys))
+		_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for idx, key := range keys {
+				// feed should contain no more than feedMaxSize items
+				cmds[idx] = pushScript.EvalSha(ctx, pipe,
+					[]string{key, feedIdsKey(key), feedEmptyKey(key)},
+					id, pub, r.feedMaxSize, createArg)
+			}
+			return nil
+		})
+		return cmds, err
+	}
+	cmds, err := run()
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		// the script is idempotent, so the pushed feeds are skipped
+		err = pushScript.Load(ctx, r.rdb).Err()
+		if err != nil {
+			return nil, err
+		}
+		cmds, err = run()
+	}
+	return cmds, err
+}
+
+func (r *RedisCache) Remove(ctx context.Context, userId string, pub string) error {
+	id, err := publicationId(pub)
+	if err != nil {
+		return err
+	}
+	_, err = r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, userId, 0, pub)
+		pipe.ZRem(ctx, feedIdsKey(userId), id)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisCache) Update(ctx context.Context, userId string,
+	update func(pubs []string) ([]string, error)) (err error) {
+	replace := func(tx *redis.Tx) error {
+		pubs, err := tx.LRange(ctx, userId, 0, r.feedMaxSize).Result()
+		if err != nil {
+			return err
+		}
+		pubs, err = update(pubs)
+		if err != nil {
+			return err
+		}
+		ids, err := r.feedIds(pubs)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			r.replaceFeed(ctx, pipe, userId, pubs, ids)
+			return nil
+		})
+		return err
+	}
+	// the feed could be pushed to while updating, then it is updated again
+	for attempt := 0; attempt < 3; attempt++ {
+		err = r.rdb.Watch(ctx, replace, userId)
+		if err != redis.TxFailedErr {
+			return
+		}
+	}
+	return
+}
+
+func (r *RedisCache) Fill(ctx context.Context, userId string, emptyTTL time.Duration,
+	load func() ([]string, error)) (filled bool, err error) {
+	emptyKey := feedEmptyKey(userId)
+	fill := func(tx *redis.Tx) error {
+		exists, err := tx.Exists(ctx, userId, emptyKey).Result()
+		if err != nil || exists > 0 {
+			return err
+		}
+		pubs, err := load()
+		if err != nil {
+			return err
+		}
+		if len(pubs) == 0 {
+			if emptyTTL <= 0 {
+				return nil
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, emptyKey, 1, emptyTTL)
+				return nil
+			})
+			return err
+		}
+		ids, err := r.feedIds(pubs)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			r.replaceFeed(ctx, pipe, userId, pubs, ids)
+			return nil
+		})
+		filled = err == nil
+		return err
+	}
+	// the feed could be pushed to while loading, then it is checked again
+	for attempt := 0; attempt < 3; attempt++ {
+		err = r.rdb.Watch(ctx, fill, userId, emptyKey)
+		if err != redis.TxFailedErr {
+			return
+		}
+	}
+	return
+}
+
+func (r *RedisCache) FeedEmpty(ctx context.Context, userId string) (bool, error) {
+	n, err := r.rdb.Exists(ctx, feedEmptyKey(userId)).Result()
+	return n == 1, err
+}
+
+func (r *RedisCache) Lock(ctx context.Context,
+	key, token string, ttl time.Duration) (bool, error) {
+	return r.rdb.SetNX(ctx, key, token, ttl).Result()
+}
+
+func (r *RedisCache) Extend(ctx context.Context,
+	key, token string, ttl time.Duration) (bool, error) {
+	n, err := extendScript.Run(ctx, r.rdb, []string{key}, token, ttl.Milliseconds()).Int()
+	return n == 1, err
+}
+
+func (r *RedisCache) Unlock(ctx context.Context, key, token string) error {
+	return unlockScript.Run(ctx, r.rdb, []string{key}, token).Err()
+}
+
+func (r *RedisCache) Revoke(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return r.rdb.SetNX(ctx, key, 1, ttl).Result()
+}
+
+func (r *RedisCache) Revoked(ctx context.Context, key string) (bool, error) {
+	n, err := r.rdb.Exists(ctx, key).Result()
+	return n == 1, err
+}
+
+func (r *RedisCache) ReplaceFollowers(ctx context.Context,
+	followers, followees map[int64][]int64) error {
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for userId, followerIds := range followers {
+			replaceSet(ctx, pipe, followedSetKey(userId), followerIds)
+		}
+		for followerId, userIds := range followees {
+			replaceSet(ctx, pipe, followsSetKey(followerId), userIds)
+		}
+		return nil
+	})
+	return err
+}
+
+func replaceSet(ctx context.Context, pipe redis.Pipeliner, key string, ids []int64) {
+	pipe.Del(ctx, key)
+	if len(ids) == 0 {
+		return
+	}
+	members := make([]interface{}, len(ids))
+	for idx, id := range ids {
+		members[idx] = id
+	}
+	pipe.SAdd(ctx, key, members...)
+}
+
+func (r *RedisCache) ReplaceFeeds(ctx context.Context, feeds map[string][]string) error {
+	ids := make(map[string][]redis.Z, len(feeds))
+	for userId, pubs := range feeds {
+		var err error
+		ids[userId], err = r.feedIds(pubs)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for userId, pubs := range feeds {
+			r.replaceFeed(ctx, pipe, userId, pubs, ids[userId])
+		}
+		return nil
+	})
+	return err
+}
+
+// replaceFeed overwrites the feed and the set of its ids.
+func (r *RedisCache) replaceFeed(ctx context.Context, pipe redis.Pipeliner,
+	userId string, pubs []string, ids []redis.Z) {
+	pipe.Del(ctx, userId, feedIdsKey(userId), feedEmptyKey(userId))
+	if len(pubs) == 0 {
+		return
+	}
+	items := make([]interface{}, len(pubs))
+	for idx, pub := range pubs {
+		items[idx] = pub
+	}
+	pipe.RPush(ctx, userId, items...)
+	pipe.LTrim(ctx, userId, 0, r.feedMaxSize)
+	pipe.ZAdd(ctx, feedIdsKey(userId), ids...)
+}
+
+// feedIds scores the ids of the publications kept in the feed by themselves.
+func (r *RedisCache) feedIds(pubs []string) ([]redis.Z, error) {
+	if int64(len(pubs)) > r.feedMaxSize+1 {
+		pubs = pubs[:r.feedMaxSize+1]
+	}
+	ids := make([]redis.Z, len(pubs))
+	for idx, pub := range pubs {
+		id, err := publicationId(pub)
+		if err != nil {
+			return nil, err
+		}
+		ids[idx] = redis.Z{Score: float64(id), Member: id}
+	}
+	return ids, nil
+}
+
+func (r *RedisCache) Checkpoint(ctx context.Context, name string) (int64, error) {
+	id, err := r.rdb.Get(ctx, name).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return id, err
+}
+
+func (r *RedisCache) SetCheckpoint(ctx context.Context, name string, id int64) error {
+	if id == 0 {
+		return r.rdb.Del(ctx, name).Err()
+	}
+	return r.rdb.Set(ctx, name, id, 0).Err()
+}
+
+func (r *RedisCache) PushAuthor(ctx context.Context,
+	author int64, id int64, pub string) (bool, error) {
+	// the author is marked once the publication can be pulled
+	_, err := r.push(ctx, []string{authorFeedKey(author)}, id, pub, true)
+	if err != nil {
+		return false, err
+	}
+	added, err := r.rdb.SAdd(ctx, celebritiesKey, author).Result()
+	return added == 1, err
+}
+
+func (r *RedisCache) ReplaceCelebrities(ctx context.Context,
+	userIds []int64, feeds map[int64][]string) error {
+	ids := make(map[int64][]redis.Z, len(feeds))
+	for author, pubs := range feeds {
+		var err error
+		ids[author], err = r.feedIds(pubs)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := r.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, userId := range userIds {
+			pubs, ok := feeds[userId]
+			r.replaceFeed(ctx, pipe, authorFeedKey(userId), pubs, ids[userId])
+			if ok {
+				pipe.SAdd(ctx, celebritiesKey, userId)
+			} else {
+				pipe.SRem(ctx, celebritiesKey, userId)
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *RedisCache) Celebrities(ctx context.Context, userIds []int64) ([]int64, error) {
+	if len(userIds) == 0 {
+		return nil, nil
+	}
+	members := make([]interface{}, len(userIds))
+	for idx, userId := range userIds {
+		members[idx] = userId
+	}
+	found, err := r.rdb.SMIsMember(ctx, celebritiesKey, members...).Result()
+	if err != nil {
+		return nil, err
+	}
+	var celebrities []int64
+	for idx, ok := range found {
+		if ok {
+			celebrities = append(celebrities, userIds[idx])
+		}
+	}
+	return celebrities, nil
+}
+
+func (r *RedisCache) AuthorFeeds(ctx context.Context,
+	authors []int64, stop int64) ([][]string, error) {
+	cmds := make([]*redis.StringSliceCmd, len(authors))
+	_, err := r.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for idx, author := range authors {
+			cmds[idx] = pipe.LRange(ctx, authorFeedKey(author), 0, stop)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	feeds := make([][]string, len(authors))
+	for idx, cmd := range cmds {
+		feeds[idx] = cmd.Val()
+	}
+	return feeds, nil
+}
+
+func followedSetKey(userId int64) string {
+	return fmt.Sprintf("%dfollowedBy", userId)
+}
+
+func followsSetKey(followerId int64) string {
+	return fmt.Sprintf("%dfollows", followerId)
+}
+
+// parseIds parses the members of a set of user ids.
+func parseIds(members []string) ([]int64, error) {
+	ids := make([]int64, len(members))
+	for idx, member := range members {
+		id, err := strconv.ParseInt(member, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids[idx] = id
+	}
+	return ids, nil
+}
+
+// feedIdsKey is the sorted set of the publication ids in the feed.
+func feedIdsKey(key string) string {
+	return key + "Ids"
+}
+
+// feedEmptyKey marks the feed known to be empty.
+func feedEmptyKey(key string) string {
+	return key + "Empty"
+}
+
+func authorFeedKey(author int64) string {
+	return fmt.Sprintf("%dpublications", author)
+}
@@ -4,126 +4,121 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v9"
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/google/uuid"
 	"github.com/labstack/echo"
-	amqp "github.com/rabbitmq/amqp091-go"
 	"golang.org/x/net/websocket"
 )
 
-const (
-	FeedMaxSize           = 1000
-	WebsocketExchangeName = "FeedExchange"
-)
-
 type Service struct {
-	ctx    context.Context
-	cancel context.CancelFunc
-	db     *sql.DB
-	rdb    *redis.Client
-	conn   *amqp.Connection
-	ch     *amqp.Channel
-	queue  *amqp.Queue
+	ctx          context.Context
+	cancel       context.CancelFunc
+	cfg          *Config
+	users        UserStore
+	followers    FollowerStore
+	publications PublicationStore
+	outbox       Outbox
+	cache        FeedCache
+	broker       Broker
+	hub          *hub
+	rebuilds     *rebuilds
+	// relay wakes the outbox relay up after adding a publication
+	relay chan struct{}
+	// fanouts waits for the fan-out workers to drain on Cancel
+	mu      sync.Mutex
+	fanouts sync.WaitGroup
 }
 
 func NewService(
-	sqlConnection string,
-	redisHost string,
-	rabbitConnection string) (*Service, error) {
-	var err error
+	cfg *Config,
+	users UserStore,
+	followers FollowerStore,
+	publications PublicationStore,
+	outbox Outbox,
+	cache FeedCache,
+	broker Broker) *Service {
 	ctx, cancel := context.WithCancel(context.Background())
-	defer func() {
-		if err != nil {
-			cancel()
-		}
-	}()
+	return &Service{
+		ctx:          ctx,
+		cancel:       cancel,
+		cfg:          cfg,
+		users:        users,
+		followers:    followers,
+		publications: publications,
+		outbox:       outbox,
+		cache:        cache,
+		broker:       broker,
+		hub:          newHub(broker),
+		rebuilds:     &rebuilds{calls: make(map[int64]*rebuildCall)},
+		relay:        make(chan struct{}, 1),
+	}
+}
 
+// Connect creates the service backed by MySQL, Redis and RabbitMQ.
+func Connect(cfg *Config) (*Service, error) {
 	// connect to MySQL
-	db, err := sql.Open("mysql", sqlConnection)
+	db, err := sql.Open("mysql", cfg.MySQL.DSN)
 	if err != nil {
 		return nil, err
 	}
+	store := NewMySQLStore(db)
 
 	// connect to Redis
 	rdb := redis.NewClient(&redis.Options{
-		Addr:     redisHost,
-		Password: "", // no password set
-		DB:       0,  // use default DB
+		Addr:         cfg.Redis.Addr,
+		Password:     cfg.Redis.Password,
+		DB:           cfg.Redis.DB,
+		DialTimeout:  cfg.Timeouts.Redis,
+		ReadTimeout:  cfg.Timeouts.Redis,
+		WriteTimeout: cfg.Timeouts.Redis,
 	})
 
 	// connect to RabbitMQ
-	conn, err := amqp.Dial(rabbitConnection)
+	broker, err := NewRabbitBroker(cfg.RabbitMQ)
 	if err != nil {
 		return nil, err
 	}
-	ch, queue := addChannel(conn)
 
-	return &Service{
-		ctx, cancel, db, rdb, conn, ch, queue,
-	}, nil
+	return NewService(cfg,
+		store, store, store, store, NewRedisCache(rdb, cfg.Feed.MaxSize), broker,
+	), nil
 }
 
 // API handlers
 
-func (s *Service) AddUser(c echo.Context) (err error) {
-	u := new(User)
-	err = c.Bind(u)
-	if err != nil {
-		return
-	}
-	tx, err := s.db.BeginTx(s.ctx, nil)
-	defer func() {
-		if err == nil {
-			err = tx.Commit()
-		} else {
-			_ = tx.Rollback()
-		}
-	}()
+func (s *Service) AddFollower(c echo.Context) (err error) {
+	var added bool
+	f := new(Follower)
+	err = c.Bind(f)
 	if err != nil {
 		return
 	}
-	_, err = tx.ExecContext(s.ctx,
-		`INSERT INTO users (login) values (?);`, u.Login)
+	// the acting user follows
+	f.FollowerId, err = authorize(c, f.FollowerId)
 	if err != nil {
 		return
 	}
-	row := tx.QueryRowContext(s.ctx, `SELECT LAST_INSERT_ID();`)
-	row.Scan(&u.Id)
-	return c.JSON(http.StatusCreated, u.Id)
-}
-
-func (s *Service) AddFollower(c echo.Context) (err error) {
-	var rowsAffected int64
-	f := new(Follower)
-	err = c.Bind(f)
+	err = validate(f)
 	if err != nil {
 		return
 	}
 	remove, _ := strconv.ParseBool(c.QueryParam("remove"))
 	if remove {
-		var tag sql.Result
-		tag, err = s.db.ExecContext(s.ctx,
-			`DELETE FROM followers WHERE userId = ? && followerId = ?;`,
-			f.UserId, f.FollowerId)
+		added, err = s.followers.RemoveFollower(s.ctx, f)
 		if err != nil {
 			return
 		}
-		rowsAffected, err = tag.RowsAffected()
-		if err != nil {
-			return
-		}
-		s.rdb.SRem(s.ctx, followedSetKey(f.UserId), f.FollowerId)
+		s.cache.RemoveFollower(s.ctx, f.UserId, f.FollowerId)
 		// invalidate unfollowed publications
 		followerId := strconv.FormatInt(f.FollowerId, 10)
-		pubsList := s.rdb.LRange(s.ctx, followerId, 0, FeedMaxSize)
-		pubs, err := pubsList.Result()
+		pubs, err := s.cache.Feed(s.ctx, followerId, 0, s.cfg.Feed.MaxSize)
 		if err != nil {
 			return err
 		}
@@ -134,24 +129,37 @@ func (s *Service) AddFollower(c echo.Context) (err error) {
 				return err
 			}
 			if p.Author == f.UserId {
-				s.rdb.LRem(s.ctx, followerId, 0, pub)
+				s.cache.Remove(s.ctx, followerId, pub)
 			}
 		}
+		// the websockets drop the unfollowed publications
+		err = s.sendToUser(followerId, FrameUnfollow, Unfollow{Author: f.UserId})
+		if err != nil {
+			c.Logger().Error(err)
+		}
 	} else {
-		var tag sql.Result
-		tag, err = s.db.ExecContext(s.ctx,
-			`INSERT INTO followers (userId, followerId) values (?, ?);`,
-			f.UserId, f.FollowerId)
+		added, err = s.followers.AddFollower(s.ctx, f)
+		if errors.Is(err, ErrUserNotFound) {
+			return fieldError(http.StatusNotFound, "userId", err.Error())
+		}
+		if errors.Is(err, ErrAlreadyFollows) {
+			return fieldError(http.StatusConflict, "userId", err.Error())
+		}
 		if err != nil {
 			return
 		}
-		rowsAffected, err = tag.RowsAffected()
+		s.cache.AddFollower(s.ctx, f.UserId, f.FollowerId)
+		// show the followed user's publications right away
+		err = s.backfillFeed(s.ctx, f)
 		if err != nil {
-			return
+			c.Logger().Error(err)
+		}
+		err = s.followCelebrity(s.ctx, f)
+		if err != nil {
+			c.Logger().Error(err)
 		}
-		s.rdb.SAdd(s.ctx, followedSetKey(f.UserId), f.FollowerId)
 	}
-	return c.JSON(http.StatusCreated, rowsAffected == 1)
+	return c.JSON(http.StatusCreated, added)
 }
 
 func (s *Service) AddPublication(c echo.Context) (err error) {
@@ -160,248 +168,278 @@ func (s *Service) AddPublication(c echo.Context) (err error) {
 	if err != nil {
 		return
 	}
-	p.At = time.Now()
-	tx, err := s.db.BeginTx(s.ctx, nil)
-	defer func() {
-		if err == nil {
-			err = tx.Commit()
-		} else {
-			_ = tx.Rollback()
-		}
-	}()
+	p.Author, err = authorize(c, p.Author)
 	if err != nil {
 		return
 	}
-	_, err = tx.ExecContext(s.ctx,
-		`INSERT INTO publications (author, txt, createdAt) values (?, ?, ?);`,
-		p.Author, p.Text, p.At)
+	err = validate(p)
 	if err != nil {
 		return
 	}
-	row := tx.QueryRowContext(s.ctx, `SELECT LAST_INSERT_ID();`)
-	row.Scan(&p.Id)
-	err = s.SendPublicationToQueue(p)
+	p.At = time.Now()
+	err = s.publications.AddPublication(s.ctx, p)
+	if errors.Is(err, ErrUserNotFound) {
+		return fieldError(http.StatusNotFound, "author", err.Error())
+	}
 	if err != nil {
 		return
 	}
+	s.wakeRelay()
 	return c.JSON(http.StatusCreated, p)
 }
 
 func (s *Service) GetFeed(c echo.Context) (err error) {
-	userId := c.Param("userId")
-	pubsList := s.rdb.LRange(s.ctx, userId, 0, FeedMaxSize)
-	pubs, err := pubsList.Result()
+	id, err := feedOwner(c)
+	if err != nil {
+		return
+	}
+	err = s.EnsureFeed(s.ctx, id)
+	if err != nil {
+		return
+	}
+	if c.QueryParam("limit") != "" || c.QueryParam("cursor") != "" {
+		return s.getFeedPage(c, id)
+	}
+	// without pagination the whole cached feed is returned
+	view, err := s.openFeed(s.ctx, id)
 	if err != nil {
 		return
 	}
-	publications := make([]Publication, len(pubs))
-	for idx, pub := range pubs {
-		p := new(Publication)
-		err = json.Unmarshal([]byte(pub), p)
+	publications, err := view(0, s.cfg.Feed.MaxSize)
+	if err != nil {
+		return
+	}
+	if publications == nil {
+		publications = []Publication{}
+	}
+	return c.JSON(http.StatusOK, publications)
+}
+
+func (s *Service) getFeedPage(c echo.Context, userId int64) (err error) {
+	limit := s.cfg.Feed.PageSize
+	if c.QueryParam("limit") != "" {
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit <= 0 || limit > s.cfg.Feed.MaxPageSize {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf(
+				"limit should be between 1 and %d", s.cfg.Feed.MaxPageSize))
+		}
+	}
+	var cursor Cursor
+	if c.QueryParam("cursor") != "" {
+		cursor, err = ParseCursor(c.QueryParam("cursor"))
 		if err != nil {
-			return
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 		}
-		publications[idx] = *p
 	}
-	return c.JSON(http.StatusOK, publications)
+	page, err := s.feedPage(s.ctx, userId, cursor, limit)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+func (s *Service) AddAnnouncement(c echo.Context) (err error) {
+	err = s.admin(c)
+	if err != nil {
+		return
+	}
+	a := new(Announcement)
+	err = c.Bind(a)
+	if err != nil {
+		return
+	}
+	err = validate(a)
+	if err != nil {
+		return
+	}
+	a.At = time.Now()
+	body, err := newFrame(FrameAnnouncement, a)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.Timeouts.Publish)
+	defer cancel()
+	err = s.broker.PublishTopic(ctx, announcementTopic, body)
+	if errors.Is(err, ErrDisconnected) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+	if err != nil {
+		return
+	}
+	return c.JSON(http.StatusCreated, a)
 }
 
 func (s *Service) UpdateFeed(c echo.Context) (err error) {
-	userId := c.Param("userId")
-	// add user's queue and start consuming messages
-	routingKey := fmt.Sprintf("user.%s", userId)
-	queue, err := s.ch.QueueDeclare(
-		routingKey+"."+uuid.NewString(), // name
-		false,                           // durable
-		false,                           // delete when unused
-		false,                           // exclusive
-		false,                           // no-wait
-		nil,                             // arguments
-	)
+	id, err := feedOwner(c)
 	if err != nil {
 		return
 	}
-	err = s.ch.QueueBind(
-		queue.Name,
-		routingKey,
-		WebsocketExchangeName,
-		true,
-		nil,
-	)
+	topics, err := s.subscriptionTopics(c, id)
 	if err != nil {
 		return
 	}
-	msgs, err := s.ch.Consume(
-		queue.Name, // queue
-		"",         // consumer
-		true,       // auto-ack
-		false,      // exclusive
-		false,      // no-local
-		false,      // no-wait
-		nil,        // args
-	)
+	since, err := parseSince(c.QueryParam("since"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	// subscribe to the user's publications and the requested topics
+	conn, err := s.subscribeLive(c.Request().Context(), id, topics)
+	if errors.Is(err, ErrDisconnected) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
 	if err != nil {
 		return
 	}
-	// send messages to the websocket
-	websocket.Handler(func(ws *websocket.Conn) {
-		defer ws.Close()
-		defer s.ch.QueueDelete(queue.Name, false, false, true)
-		for msg := range msgs {
-			err := websocket.Message.Send(ws, msg.Body)
-			if err != nil {
-				c.Logger().Error(err)
-			}
+	// the hub connection is removed even if the handshake fails
+	defer s.hub.unsubscribe(context.Background(), conn)
+	websocket.Server{
+		Handshake: handshakeWebsocket,
+		Handler: func(ws *websocket.Conn) {
+			s.serveWebsocket(c, ws, conn, id, since)
+		},
+	}.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// StreamFeed sends the updates of UpdateFeed as server-sent events,
+// the stream resumes after the publication of the Last-Event-ID header.
+func (s *Service) StreamFeed(c echo.Context) (err error) {
+	id, err := feedOwner(c)
+	if err != nil {
+		return
+	}
+	topics, err := s.subscriptionTopics(c, id)
+	if err != nil {
+		return
+	}
+	lastEventId := c.Request().Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = c.QueryParam("since")
+	}
+	since, err := parseSince(lastEventId)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	conn, err := s.subscribeLive(c.Request().Context(), id, topics)
+	if errors.Is(err, ErrDisconnected) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+	if err != nil {
+		return
+	}
+	defer s.hub.unsubscribe(context.Background(), conn)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	// nginx buffers the responses otherwise
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+	st := s.newStream(conn, id, &sseTransport{res: res}, c.Request().Context().Done())
+	if since >= 0 {
+		err = st.replay(since)
+		if err != nil {
+			c.Logger().Error(err)
+			return nil
 		}
-	}).ServeHTTP(c.Response(), c.Request())
+	}
+	st.run(c, s.cfg.SSE.KeepaliveInterval)
 	return nil
 }
 
-// AMQP Methods
+// Health reports the state of the broker connection.
+func (s *Service) Health(c echo.Context) error {
+	state := s.broker.State()
+	code := http.StatusOK
+	if state != BrokerConnected {
+		code = http.StatusServiceUnavailable
+	}
+	return c.JSON(code, map[string]string{"broker": state.String()})
+}
 
-func (s *Service) SendPublicationToQueue(pub *Publication) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// Broker Methods
 
-	body, err := json.Marshal(pub)
-	if err != nil {
-		return err
+// sendToQueue retries the publication until the broker confirms it
+// or the context is cancelled.
+func (s *Service) sendToQueue(ctx context.Context, body []byte) (err error) {
+	for attempt := 0; attempt <= s.cfg.RabbitMQ.PublishRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("retrying publication: %v", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * s.cfg.RabbitMQ.PublishRetryBackoff):
+			}
+		}
+		err = s.publish(ctx, body)
+		if err == nil {
+			return nil
+		}
 	}
+	return err
+}
 
-	return s.ch.PublishWithContext(ctx,
-		"",           // exchange
-		s.queue.Name, // routing key
-		false,        // mandatory
-		false,        // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		})
+func (s *Service) publish(ctx context.Context, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeouts.Publish)
+	defer cancel()
+
+	return s.broker.Publish(ctx, body)
 }
 
 func (s *Service) SendPublicationToExchange(followerId string, pub *Publication) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	return s.sendToUser(followerId, FramePublication, pub)
+}
+
+// sendToUser sends the live update to the user's websockets.
+func (s *Service) sendToUser(userId string, typ string, payload interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeouts.Publish)
 	defer cancel()
 
-	body, err := json.Marshal(pub)
+	body, err := newFrame(typ, payload)
 	if err != nil {
 		return err
 	}
 
-	return s.ch.PublishWithContext(ctx,
-		WebsocketExchangeName,              // exchange
-		fmt.Sprintf("user.%s", followerId), // routing key
-		true,                               // mandatory
-		false,                              // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		})
+	return s.broker.PublishTopic(ctx, userTopic(userId), body)
 }
 
 func (s *Service) UpdateFeeds() {
-	msgs, err := s.ch.Consume(
-		s.queue.Name, // queue
-		"",           // consumer
-		true,         // auto-ack
-		false,        // exclusive
-		false,        // no-local
-		false,        // no-wait
-		nil,          // args
-	)
+	s.mu.Lock()
+	if s.ctx.Err() != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.fanouts.Add(1)
+	s.mu.Unlock()
+	defer s.fanouts.Done()
+
+	msgs, err := s.broker.Consume()
 	if err != nil {
 		log.Print(err, "Failed to register a consumer")
+		return
 	}
+	s.dispatch(msgs)
+}
 
-	go func() {
-		for msg := range msgs {
-			p := new(Publication)
-			_ = json.Unmarshal(msg.Body, p)
-			followersSet := s.rdb.SMembers(s.ctx, followedSetKey(p.Author))
-			followers, _ := followersSet.Result()
-			for _, follower := range followers {
-				// send publication to websocket
-				err := s.SendPublicationToExchange(follower, p)
-				if err != nil {
-					log.Println(err.Error())
-				}
-				// add publication to the cashed feed
-				res := s.rdb.LPush(s.ctx, follower, string(msg.Body))
-				err = res.Err()
-				if err != nil {
-					log.Println(err.Error())
-				}
-				// feed should contain no more than FeedMaxSize items
-				resTrim := s.rdb.LTrim(s.ctx, follower, 0, FeedMaxSize)
-				err = resTrim.Err()
-				if err != nil {
-					log.Println(err.Error())
-				}
-			}
-		}
-	}()
+// DeadLetters lists the publications rejected by the fan-out.
+func (s *Service) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	return s.broker.DeadLetters(ctx)
+}
 
-	<-s.ctx.Done()
+// ReplayDeadLetters sends the rejected publications to the fan-out again.
+func (s *Service) ReplayDeadLetters(ctx context.Context) (int, error) {
+	return s.broker.ReplayDeadLetters(ctx)
 }
 
 // Helpers
 
-func (s *Service) Db() *sql.DB {
-	return s.db
-}
-
+// Cancel stops receiving publications, waits for the fan-out
+// of the received ones and closes the broker.
 func (s *Service) Cancel() {
-	defer s.ch.Close()
-	defer s.conn.Close()
+	defer s.broker.Close()
+	s.mu.Lock()
 	s.cancel()
-}
-
-func (s *Service) ReopenChannel() {
-	errReceiver := make(chan *amqp.Error)
-	s.ch.NotifyClose(errReceiver)
-	for err := range errReceiver {
-		log.Print(err)
-		close(errReceiver)
-		s.ch, s.queue = addChannel(s.conn)
-		errReceiver = make(chan *amqp.Error)
-		s.ch.NotifyClose(errReceiver)
-	}
-}
-
-func addChannel(conn *amqp.Connection) (*amqp.Channel, *amqp.Queue) {
-	ch, err := conn.Channel()
-	if err != nil {
-		log.Print(err)
-		return addChannel(conn)
-	}
-	queue, err := ch.QueueDeclare(
-		"publications", // name
-		false,          // durable
-		false,          // delete when unused
-		false,          // exclusive
-		false,          // no-wait
-		nil,            // arguments
-	)
-	if err != nil {
-		log.Print(err)
-		return addChannel(conn)
-	}
-	err = ch.ExchangeDeclare(
-		WebsocketExchangeName, // name
-		"direct",              // kind
-		true,                  // durable
-		false,                 // autoDelete
-		false,                 // internal
-		false,                 // noWait
-		nil,                   // args
-	)
-	if err != nil {
-		log.Print(err)
-		return addChannel(conn)
-	}
-	return ch, &queue
-}
-
-func followedSetKey(userId int64) string {
-	return fmt.Sprintf("%dfollowedBy", userId)
+	s.mu.Unlock()
+	s.fanouts.Wait()
 }
@@ -0,0 +1,59 @@
+package feed
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// sseTransport writes the updates as server-sent events named by
+// the frame types, the publications carry their ids as the event ids.
+type sseTransport struct {
+	res *echo.Response
+}
+
+func (t *sseTransport) send(f *Frame, body []byte) error {
+	var event bytes.Buffer
+	if f.Type == FramePublication {
+		id, err := publicationId(string(f.Payload))
+		if err == nil && id > 0 {
+			fmt.Fprintf(&event, "id: %d\n", id)
+		}
+	}
+	fmt.Fprintf(&event, "event: %s\n", f.Type)
+	for _, line := range bytes.Split(f.Payload, []byte("\n")) {
+		fmt.Fprintf(&event, "data: %s\n", line)
+	}
+	event.WriteString("\n")
+	return t.write(event.Bytes())
+}
+
+// keepalive writes a comment ignored by the browser.
+func (t *sseTransport) keepalive() error {
+	return t.write([]byte(": keepalive\n\n"))
+}
+
+func (t *sseTransport) write(event []byte) error {
+	_, err := t.res.Write(event)
+	if err != nil {
+		return err
+	}
+	t.res.Flush()
+	return nil
+}
+
+// parseSince parses the id of the last seen publication,
+// the empty one is -1 and replays nothing.
+func parseSince(since string) (int64, error) {
+	if since == "" {
+		return -1, nil
+	}
+	id, err := strconv.ParseInt(since, 10, 64)
+	if err != nil || id < 0 {
+		return 0, errors.New("since should be a publication id")
+	}
+	return id, nil
+}
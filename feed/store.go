@@ -0,0 +1,212 @@
+package feed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrLoginTaken     = errors.New("login is taken")
+	ErrUserNotFound   = errors.New("user is not found")
+	ErrAlreadyFollows = errors.New("user is already followed")
+	ErrNotFollowed    = errors.New("user is not followed")
+)
+
+// UserStore persists user accounts.
+type UserStore interface {
+	// AddUser stores u and assigns its id,
+	// ErrLoginTaken is returned for a login of another user.
+	AddUser(ctx context.Context, u *User) error
+	// UserByLogin returns the user with the login or ErrUserNotFound.
+	UserByLogin(ctx context.Context, login string) (*User, error)
+	// SetPassword replaces the password hash of the user with the login
+	// or returns ErrUserNotFound.
+	SetPassword(ctx context.Context, login, hash string) error
+	// UserIds returns up to limit ids greater than afterId in ascending order.
+	UserIds(ctx context.Context, afterId int64, limit int) ([]int64, error)
+}
+
+// FollowerStore persists the follower relations.
+type FollowerStore interface {
+	// AddFollower reports whether a new relation was stored,
+	// ErrAlreadyFollows is returned for an existing one and
+	// ErrUserNotFound for a missing user.
+	AddFollower(ctx context.Context, f *Follower) (bool, error)
+	// RemoveFollower reports whether an existing relation was removed.
+	RemoveFollower(ctx context.Context, f *Follower) (bool, error)
+	// FollowerIds returns the followers of each of the users.
+	FollowerIds(ctx context.Context, userIds []int64) (map[int64][]int64, error)
+	// FolloweeIds returns the users followed by each of the followers.
+	FolloweeIds(ctx context.Context, followerIds []int64) (map[int64][]int64, error)
+	// FollowingIds returns up to limit ids greater than afterId
+	// of the users following someone in ascending order.
+	FollowingIds(ctx context.Context, afterId int64, limit int) ([]int64, error)
+}
+
+// PublicationStore persists publications.
+type PublicationStore interface {
+	// AddPublication stores p together with its outbox entry
+	// and assigns its id, ErrUserNotFound is returned for a missing author.
+	AddPublication(ctx context.Context, p *Publication) error
+	// Feed returns up to limit publications of the users followed by userId
+	// beyond the cursor, newest first.
+	Feed(ctx context.Context, userId int64, cursor Cursor, limit int) ([]Publication, error)
+	// Feeds returns up to limit newest publications of the feed
+	// of each of the users.
+	Feeds(ctx context.Context, userIds []int64, limit int) (map[int64][]Publication, error)
+	// Recent returns up to limit newest publications of the author.
+	Recent(ctx context.Context, author int64, limit int) ([]Publication, error)
+}
+
+// Outbox keeps the publications waiting to be sent to the fan-out.
+type Outbox interface {
+	// PendingOutbox returns up to limit unsent entries in the order of adding.
+	PendingOutbox(ctx context.Context, limit int) ([]OutboxEntry, error)
+	// MarkSent marks the entries sent.
+	MarkSent(ctx context.Context, ids []int64) error
+}
+
+// OutboxEntry is a serialized publication waiting to be sent.
+type OutboxEntry struct {
+	Id   int64
+	Body []byte
+}
+
+// FeedCache keeps the followedBy and the follows sets
+// and the cached feed of every user.
+type FeedCache interface {
+	// AddFollower adds the follower to the followedBy set of the user
+	// and the user to the follows set of the follower.
+	AddFollower(ctx context.Context, userId, followerId int64) error
+	RemoveFollower(ctx context.Context, userId, followerId int64) error
+	// Followers returns the ids of the users following userId.
+	Followers(ctx context.Context, userId int64) ([]string, error)
+	FollowerCount(ctx context.Context, userId int64) (int64, error)
+	// Followees returns the ids of the users followed by followerId.
+	Followees(ctx context.Context, followerId int64) ([]int64, error)
+	// Feed returns the serialized publications of the user's feed between
+	// start and stop inclusive, newest first.
+	Feed(ctx context.Context, userId string, start, stop int64) ([]string, error)
+	// PushMany prepends the serialized publication with the id to the feeds
+	// of the users in a single round trip, skipping the feeds which already
+	// contain it, and returns the users whose feeds got it. The missing
+	// feeds are left to EnsureFeed, the users whose missing feeds
+	// have not seen the publication yet are returned separately.
+	// A feed cached as empty is started with the publication.
+	PushMany(ctx context.Context, userIds []string,
+		id int64, pub string) (pushed, missing []string, err error)
+	// Remove deletes every occurrence of the serialized publication.
+	Remove(ctx context.Context, userId string, pub string) error
+	// Update atomically replaces the whole feed with the result of update.
+	Update(ctx context.Context, userId string,
+		update func(pubs []string) ([]string, error)) error
+	// Fill stores the serialized publications returned by load, newest first,
+	// when the user's feed is missing and reports whether it was filled.
+	// An empty feed is cached as empty for emptyTTL.
+	Fill(ctx context.Context, userId string, emptyTTL time.Duration,
+		load func() ([]string, error)) (bool, error)
+	// FeedEmpty reports whether the user's feed is cached as empty.
+	FeedEmpty(ctx context.Context, userId string) (bool, error)
+	// Lock acquires the key for ttl on behalf of the holder's token
+	// and reports whether it was free.
+	Lock(ctx context.Context, key, token string, ttl time.Duration) (bool, error)
+	// Extend prolongs the lock to ttl and reports whether
+	// the token still holds it.
+	Extend(ctx context.Context, key, token string, ttl time.Duration) (bool, error)
+	// Unlock releases the lock only if the token holds it.
+	Unlock(ctx context.Context, key, token string) error
+	// Revoke marks the key revoked for ttl and reports
+	// whether it was not revoked yet.
+	Revoke(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Revoked reports whether the key is revoked.
+	Revoked(ctx context.Context, key string) (bool, error)
+	// ReplaceFollowers overwrites the followedBy sets of the users
+	// by their followers and the follows sets by their followees.
+	ReplaceFollowers(ctx context.Context, followers, followees map[int64][]int64) error
+	// ReplaceFeeds overwrites the feeds of the users,
+	// the publications are serialized and newest first.
+	ReplaceFeeds(ctx context.Context, feeds map[string][]string) error
+	// Checkpoint returns the last id saved under the name, zero if none.
+	Checkpoint(ctx context.Context, name string) (int64, error)
+	// SetCheckpoint saves the id under the name, zero removes it.
+	SetCheckpoint(ctx context.Context, name string, id int64) error
+	// ReplaceCelebrities overwrites the own feeds of the celebrities among
+	// the users and marks them, the other users are unmarked.
+	ReplaceCelebrities(ctx context.Context, userIds []int64, feeds map[int64][]string) error
+	// PushAuthor prepends the serialized publication with the id to the
+	// author's own feed unless it already contains it, marks the author
+	// as a celebrity and reports whether the author was not marked yet.
+	PushAuthor(ctx context.Context, author int64, id int64, pub string) (bool, error)
+	// Celebrities returns the celebrities among the users.
+	Celebrities(ctx context.Context, userIds []int64) ([]int64, error)
+	// AuthorFeeds returns the serialized publications of each author's own
+	// feed between 0 and stop inclusive, newest first.
+	AuthorFeeds(ctx context.Context, authors []int64, stop int64) ([][]string, error)
+}
+
+// Broker carries publications to the fan-out and to the live websockets.
+type Broker interface {
+	// Publish sends a serialized publication to the fan-out queue.
+	Publish(ctx context.Context, body []byte) error
+	// PublishTopic sends a serialized live update to the websockets
+	// subscribed to the topic.
+	PublishTopic(ctx context.Context, topic string, body []byte) error
+	// Consume starts consuming the fan-out queue, the rejected
+	// publications go to the dead-letter queue.
+	Consume() (<-chan Delivery, error)
+	// Listen starts consuming the live updates of the process' queue,
+	// which receives the topics matching its bindings.
+	Listen() (<-chan Delivery, error)
+	// Bind routes the topics matching the pattern to the process' queue.
+	Bind(ctx context.Context, pattern string) error
+	// Unbind stops routing the topics matching the pattern.
+	Unbind(ctx context.Context, pattern string) error
+	// DeadLetters lists the dead-letter queue leaving it intact.
+	DeadLetters(ctx context.Context) ([]DeadLetter, error)
+	// ReplayDeadLetters moves the dead-letter queue to the fan-out queue
+	// and returns the number of moved publications.
+	ReplayDeadLetters(ctx context.Context) (int, error)
+	// State reports whether the broker is connected.
+	State() BrokerState
+	Close() error
+}
+
+type BrokerState int
+
+const (
+	BrokerConnected BrokerState = iota
+	BrokerReconnecting
+	BrokerClosed
+)
+
+func (s BrokerState) String() string {
+	switch s {
+	case BrokerConnected:
+		return "connected"
+	case BrokerReconnecting:
+		return "reconnecting"
+	case BrokerClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("BrokerState(%d)", int(s))
+}
+
+// Delivery is a received publication, which is acknowledged once
+// processed or rejected to be redelivered or dead-lettered.
+type Delivery struct {
+	// Topic is the routing key of a live update.
+	Topic string
+	Body  []byte
+	Ack   func() error
+	Nack  func(requeue bool) error
+}
+
+// DeadLetter is a publication rejected by the fan-out.
+type DeadLetter struct {
+	Body   []byte
+	Reason string
+	Count  int64
+	At     time.Time
+}
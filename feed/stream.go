@@ -0,0 +1,169 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// transport writes the updates of a stream to the client.
+type transport interface {
+	// send writes the frame, body is its serialized form.
+	send(f *Frame, body []byte) error
+	// keepalive tells the client and the proxies the stream is alive.
+	keepalive() error
+}
+
+// stream sends the missed publications followed by the live updates of
+// the hub connection to a websocket or an event stream. Its goroutine
+// is the only writer of the transport.
+type stream struct {
+	s      *Service
+	conn   *hubConn
+	userId int64
+	out    transport
+	// a publication matching several topics or received live
+	// while being replayed is sent once
+	sent *recentIds
+	// replies are sent between the updates
+	replies chan Frame
+	// closed stops the stream when the client goes away
+	closed <-chan struct{}
+}
+
+func (s *Service) newStream(conn *hubConn, userId int64,
+	out transport, closed <-chan struct{}) *stream {
+	return &stream{
+		s:       s,
+		conn:    conn,
+		userId:  userId,
+		out:     out,
+		sent:    newRecentIds(recentIdsSize),
+		replies: make(chan Frame, 16),
+		closed:  closed,
+	}
+}
+
+// replay sends the publications of the user's feed newer than since.
+// The publications are read after subscribing, the live ones received
+// meanwhile wait in the hub's backlog of the connection.
+func (st *stream) replay(since int64) error {
+	missed, err := st.s.missedPublications(st.s.ctx, st.userId, since)
+	if err != nil {
+		return err
+	}
+	for _, body := range missed {
+		err = st.deliver(body)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run sends the live updates, the replies and the keepalives
+// until the client goes away or the hub drops the connection.
+// The updates received while replaying are sent first.
+func (st *stream) run(c echo.Context, keepaliveInterval time.Duration) {
+	for _, body := range st.s.hub.replayed(st.conn) {
+		err := st.deliver(body)
+		if err != nil {
+			c.Logger().Error(err)
+			return
+		}
+	}
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case <-st.closed:
+			return
+		case body, ok := <-st.conn.out:
+			if !ok {
+				// the hub dropped the connection
+				return
+			}
+			err = st.deliver(body)
+		case reply := <-st.replies:
+			var body []byte
+			body, err = json.Marshal(reply)
+			if err == nil {
+				err = st.out.send(&reply, body)
+			}
+		case <-keepalive.C:
+			err = st.out.keepalive()
+		}
+		if err != nil {
+			// the connection is broken, the client reconnects
+			c.Logger().Error(err)
+			return
+		}
+	}
+}
+
+// deliver sends the live update frame once.
+func (st *stream) deliver(body []byte) error {
+	f := new(Frame)
+	err := json.Unmarshal(body, f)
+	if err != nil {
+		return err
+	}
+	internal, err := st.s.followLive(st.conn, f)
+	if err != nil || internal {
+		return err
+	}
+	if f.Type == FramePublication {
+		id, _ := publicationId(string(f.Payload))
+		if !st.sent.add(id) {
+			return nil
+		}
+	}
+	return st.out.send(f, body)
+}
+
+// missedPublications returns the publication frames of the user's feed
+// newer than since, oldest first.
+func (s *Service) missedPublications(ctx context.Context,
+	userId, since int64) ([][]byte, error) {
+	pubs, err := s.newerPublications(ctx, userId, since)
+	if err != nil {
+		return nil, err
+	}
+	var missed [][]byte
+	for idx := len(pubs) - 1; idx >= 0; idx-- {
+		body, err := newFrame(FramePublication, pubs[idx])
+		if err != nil {
+			return nil, err
+		}
+		missed = append(missed, body)
+	}
+	return missed, nil
+}
+
+// newerPublications returns the publications of the user's feed
+// newer than since, newest first.
+func (s *Service) newerPublications(ctx context.Context,
+	userId, since int64) ([]Publication, error) {
+	err := s.EnsureFeed(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	view, err := s.openFeed(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	pubs, err := view(0, s.cfg.Feed.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	newer := pubs[:0]
+	for _, p := range pubs {
+		if p.Id > since {
+			newer = append(newer, p)
+		}
+	}
+	return newer, nil
+}
@@ -0,0 +1,253 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// The live updates are routed by the topic exchange, a websocket
+// subscribes to its user's fan-out and optionally to the publications
+// of authors, hashtags and system announcements.
+const announcementTopic = "system.announcement"
+
+// recentIdsSize is the number of publications remembered by a websocket
+// to skip the ones received through several topics.
+const recentIdsSize = 256
+
+var (
+	hashtagRegExp = regexp.MustCompile(`#([\p{L}\p{N}_]+)`)
+	tagRegExp     = regexp.MustCompile(`^[\p{L}\p{N}_]+$`)
+)
+
+func userTopic(userId string) string {
+	return "user." + userId
+}
+
+func authorTopic(author int64) string {
+	return fmt.Sprintf("author.%d.publication", author)
+}
+
+// authorPattern matches every event of the author.
+func authorPattern(author int64) string {
+	return fmt.Sprintf("author.%d.*", author)
+}
+
+func presenceTopic(userId int64) string {
+	return fmt.Sprintf("presence.%d", userId)
+}
+
+func hashtagTopic(tag string) string {
+	return "hashtag." + tag
+}
+
+// hashtags returns the distinct hashtags of the text in lower case.
+func hashtags(text string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, match := range hashtagRegExp.FindAllStringSubmatch(text, -1) {
+		tag := strings.ToLower(match[1])
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// validHashtag reports whether the tag could be a word of a routing key.
+func validHashtag(tag string) bool {
+	return tagRegExp.MatchString(tag)
+}
+
+// topicMatches matches the routing key against the pattern like the topic
+// exchange does: "*" is exactly one word and "#" is zero or more words.
+func topicMatches(pattern, key string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(key, "."))
+}
+
+func matchWords(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for skip := 0; skip <= len(key); skip++ {
+			if matchWords(pattern[1:], key[skip:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && matchWords(pattern[1:], key[1:])
+	}
+	return len(key) > 0 && pattern[0] == key[0] && matchWords(pattern[1:], key[1:])
+}
+
+// Subscription lists the optional topics of a websocket.
+type Subscription struct {
+	Authors       []int64  `json:"authors,omitempty"`
+	Hashtags      []string `json:"hashtags,omitempty"`
+	Announcements bool     `json:"announcements,omitempty"`
+	// Presence lists the followed users whose presence is followed.
+	Presence []int64 `json:"presence,omitempty"`
+}
+
+// topics returns the patterns of the subscription.
+func (sub *Subscription) topics() ([]string, error) {
+	var topics []string
+	for _, author := range sub.Authors {
+		topics = append(topics, authorPattern(author))
+	}
+	for _, param := range sub.Hashtags {
+		tag := strings.ToLower(strings.TrimPrefix(param, "#"))
+		if !validHashtag(tag) {
+			return nil, fmt.Errorf("invalid hashtag %q", param)
+		}
+		topics = append(topics, hashtagTopic(tag))
+	}
+	if sub.Announcements {
+		topics = append(topics, announcementTopic)
+	}
+	for _, userId := range sub.Presence {
+		topics = append(topics, presenceTopic(userId))
+	}
+	return topics, nil
+}
+
+// subscriptionTopics returns the user's topic and the ones requested by
+// the authors, hashtags, announcements and presence query parameters.
+func (s *Service) subscriptionTopics(c echo.Context, userId int64) ([]string, error) {
+	sub := new(Subscription)
+	for _, param := range splitParam(c.QueryParam("authors")) {
+		author, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest,
+				fmt.Sprintf("invalid author %q", param))
+		}
+		sub.Authors = append(sub.Authors, author)
+	}
+	sub.Hashtags = splitParam(c.QueryParam("hashtags"))
+	if c.QueryParam("announcements") != "" {
+		announcements, err := strconv.ParseBool(c.QueryParam("announcements"))
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest,
+				"announcements should be a boolean")
+		}
+		sub.Announcements = announcements
+	}
+	for _, param := range splitParam(c.QueryParam("presence")) {
+		user, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest,
+				fmt.Sprintf("invalid user %q", param))
+		}
+		sub.Presence = append(sub.Presence, user)
+	}
+	topics, err := sub.topics()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	err = s.checkPresence(c.Request().Context(), userId, sub.Presence)
+	if errors.Is(err, ErrNotFollowed) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{userTopic(strconv.FormatInt(userId, 10))}, topics...), nil
+}
+
+// checkPresence lets the user follow the presence only of the users
+// it follows.
+func (s *Service) checkPresence(ctx context.Context, userId int64, presence []int64) error {
+	if len(presence) == 0 {
+		return nil
+	}
+	followees, err := s.cache.Followees(ctx, userId)
+	if err != nil {
+		return err
+	}
+	followed := make(map[int64]bool, len(followees))
+	for _, followee := range followees {
+		followed[followee] = true
+	}
+	for _, user := range presence {
+		if !followed[user] {
+			return fmt.Errorf("presence of user %d: %w", user, ErrNotFollowed)
+		}
+	}
+	return nil
+}
+
+func splitParam(param string) []string {
+	var values []string
+	for _, value := range strings.Split(param, ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// publishTopics sends the fanned out publication to the websockets
+// subscribed to the author or the hashtags.
+func (s *Service) publishTopics(p *Publication, body []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeouts.Publish)
+	defer cancel()
+
+	frame, err := newFrame(FramePublication, json.RawMessage(body))
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	topics := []string{authorTopic(p.Author)}
+	for _, tag := range hashtags(p.Text) {
+		topics = append(topics, hashtagTopic(tag))
+	}
+	for _, topic := range topics {
+		err := s.broker.PublishTopic(ctx, topic, frame)
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}
+}
+
+// recentIds remembers the last publication ids.
+type recentIds struct {
+	ids  []int64
+	next int
+	seen map[int64]bool
+}
+
+func newRecentIds(size int) *recentIds {
+	return &recentIds{ids: make([]int64, 0, size), seen: make(map[int64]bool)}
+}
+
+// add reports whether the id is new, a zero id is never remembered.
+func (r *recentIds) add(id int64) bool {
+	if id == 0 {
+		return true
+	}
+	if r.seen[id] {
+		return false
+	}
+	if len(r.ids) < cap(r.ids) {
+		r.ids = append(r.ids, id)
+	} else {
+		delete(r.seen, r.ids[r.next])
+		r.ids[r.next] = id
+		r.next = (r.next + 1) % len(r.ids)
+	}
+	r.seen[id] = true
+	return true
+}
@@ -5,16 +5,40 @@ import "time"
 type User struct {
 	Id    int64  `json:"id"`
 	Login string `json:"name"`
+	// PasswordHash is the bcrypt hash of the password.
+	PasswordHash string `json:"-"`
 }
 
+// Credentials register an account and log in to it.
+type Credentials struct {
+	Login string `json:"login" validate:"required,max=25"`
+	// bcrypt ignores the password beyond 72 bytes
+	Password string `json:"password" validate:"required,min=8,maxbytes=72"`
+}
+
+// Tokens are issued on login and refresh, the access token
+// authenticates the requests and the refresh token renews both.
+type Tokens struct {
+	AccessToken  string `json:"accessToken,omitempty"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// The fields of the requests are checked by the rules
+// of their validate tags, see validate.
+
 type Follower struct {
-	UserId     int64 `json:"userId"`
-	FollowerId int64 `json:"followerId"`
+	UserId     int64 `json:"userId" validate:"required,min=1"`
+	FollowerId int64 `json:"followerId" validate:"required,nefield=UserId"`
 }
 
 type Publication struct {
 	Id     int64     `json:"id"`
 	Author int64     `json:"author"`
-	Text   string    `json:"text"`
+	Text   string    `json:"text" validate:"required,max=512"`
 	At     time.Time `json:"at"`
 }
+
+type Announcement struct {
+	Text string    `json:"text" validate:"required,max=512"`
+	At   time.Time `json:"at"`
+}
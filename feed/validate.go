@@ -0,0 +1,130 @@
+package feed
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+)
+
+// ErrorResponse is the body of a rejected request,
+// Fields explain the rejected fields of the request.
+type ErrorResponse struct {
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// fieldError rejects the request because of the field.
+func fieldError(code int, field, message string) *echo.HTTPError {
+	return echo.NewHTTPError(code, &ErrorResponse{
+		Message: message,
+		Fields:  []FieldError{{Field: field, Message: message}},
+	})
+}
+
+// rule checks the field of the struct against the parameter
+// and explains the violation.
+type rule func(s, field reflect.Value, param string) (string, bool)
+
+// rules are used in the validate tags of the fields as the comma
+// separated names with the optional parameters: `validate:"required,max=25"`.
+var rules = map[string]rule{
+	// required rejects the zero value
+	"required": func(s, field reflect.Value, param string) (string, bool) {
+		return "is required", !field.IsZero()
+	},
+	// min is the least number of the characters of a string
+	// or the least number
+	"min": func(s, field reflect.Value, param string) (string, bool) {
+		min := ruleInt(param)
+		if field.Kind() == reflect.String {
+			return fmt.Sprintf("should have at least %d characters", min),
+				utf8.RuneCountInString(field.String()) >= min
+		}
+		return fmt.Sprintf("should be at least %d", min), field.Int() >= int64(min)
+	},
+	// max is the greatest number of the characters of a string
+	// or the greatest number
+	"max": func(s, field reflect.Value, param string) (string, bool) {
+		max := ruleInt(param)
+		if field.Kind() == reflect.String {
+			return fmt.Sprintf("should have at most %d characters", max),
+				utf8.RuneCountInString(field.String()) <= max
+		}
+		return fmt.Sprintf("should be at most %d", max), field.Int() <= int64(max)
+	},
+	// maxbytes is the greatest length of a string in bytes
+	"maxbytes": func(s, field reflect.Value, param string) (string, bool) {
+		max := ruleInt(param)
+		return fmt.Sprintf("should have at most %d bytes", max), field.Len() <= max
+	},
+	// nefield rejects the value of the named field
+	"nefield": func(s, field reflect.Value, param string) (string, bool) {
+		other, ok := s.Type().FieldByName(param)
+		if !ok {
+			panic(fmt.Sprintf("nefield: no field %s in %s", param, s.Type()))
+		}
+		return "should differ from " + jsonName(other),
+			field.Interface() != s.FieldByIndex(other.Index).Interface()
+	},
+}
+
+func ruleInt(param string) int {
+	n, err := strconv.Atoi(param)
+	if err != nil {
+		panic(fmt.Sprintf("invalid rule parameter %q", param))
+	}
+	return n
+}
+
+// validate checks the fields of the struct against the rules of their
+// validate tags, a field is reported once by its first broken rule.
+// The violations are rejected with 422 Unprocessable Entity.
+func validate(v interface{}) error {
+	s := reflect.Indirect(reflect.ValueOf(v))
+	var fields []FieldError
+	for idx := 0; idx < s.NumField(); idx++ {
+		field := s.Type().Field(idx)
+		tag := field.Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		for _, r := range strings.Split(tag, ",") {
+			name, param, _ := strings.Cut(r, "=")
+			check, ok := rules[name]
+			if !ok {
+				panic(fmt.Sprintf("unknown rule %q of %s.%s", name, s.Type(), field.Name))
+			}
+			message, ok := check(s, s.Field(idx), param)
+			if !ok {
+				fields = append(fields, FieldError{Field: jsonName(field), Message: message})
+				break
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return echo.NewHTTPError(http.StatusUnprocessableEntity, &ErrorResponse{
+		Message: "invalid " + strings.ToLower(s.Type().Name()),
+		Fields:  fields,
+	})
+}
+
+// jsonName returns the name of the field in the requests.
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
@@ -0,0 +1,274 @@
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/labstack/echo"
+	"golang.org/x/net/websocket"
+)
+
+// session serves a websocket subscribed to the hub, the reader handles
+// the client's commands and detects the closed or idle websocket.
+type session struct {
+	*stream
+	c  echo.Context
+	ws *websocket.Conn
+	// v1 speaks ProtocolV1, otherwise the legacy messages are sent
+	v1     bool
+	closed chan struct{} // closed by the reader
+	done   chan struct{} // closed by the writer
+	acked  int64
+}
+
+// seenCheckpoint keeps the last publication acknowledged by the user.
+func seenCheckpoint(userId int64) string {
+	return fmt.Sprintf("seen.%d", userId)
+}
+
+// serveWebsocket sends the publications missed since the given or
+// the acknowledged one followed by the live updates to the websocket
+// and pings it until the client goes away. A negative since replays
+// only the publications missed by a v1 client.
+func (s *Service) serveWebsocket(c echo.Context, ws *websocket.Conn,
+	conn *hubConn, userId int64, since int64) {
+	defer ws.Close()
+	ss := &session{
+		c:      c,
+		ws:     ws,
+		v1:     isProtocolV1(ws),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	ss.stream = s.newStream(conn, userId, &websocketTransport{
+		ws:           ws,
+		v1:           ss.v1,
+		writeTimeout: s.cfg.Websocket.WriteTimeout,
+	}, ss.closed)
+	defer close(ss.done)
+	err := ss.start(since)
+	if err != nil {
+		c.Logger().Error(err)
+		return
+	}
+	go ss.read()
+	ss.run(c, s.cfg.Websocket.PingInterval)
+}
+
+// start greets the v1 client and replays the missed publications.
+func (ss *session) start(since int64) error {
+	if ss.v1 {
+		hello, err := newFrame(FrameHello, Hello{Version: 1})
+		if err == nil {
+			err = ss.out.send(&Frame{Type: FrameHello}, hello)
+		}
+		if err != nil {
+			return err
+		}
+		ss.acked, err = ss.s.cache.Checkpoint(ss.s.ctx, seenCheckpoint(ss.userId))
+		if err != nil {
+			return err
+		}
+		if since < 0 && ss.acked > 0 {
+			since = ss.acked
+		}
+	}
+	if since < 0 {
+		return nil
+	}
+	return ss.replay(since)
+}
+
+// websocketTransport sends the frames of ProtocolV1 or the legacy
+// messages and pings the client.
+type websocketTransport struct {
+	ws           *websocket.Conn
+	v1           bool
+	writeTimeout time.Duration
+}
+
+func (t *websocketTransport) send(f *Frame, body []byte) error {
+	if !t.v1 {
+		var ok bool
+		body, ok = legacyMessage(f)
+		if !ok {
+			return nil
+		}
+	}
+	err := t.ws.SetWriteDeadline(time.Now().Add(t.writeTimeout))
+	if err != nil {
+		return err
+	}
+	return websocket.Message.Send(t.ws, body)
+}
+
+// keepalive sends a ping frame, the pong is answered by the browser
+// and skipped by the reader.
+func (t *websocketTransport) keepalive() error {
+	err := t.ws.SetWriteDeadline(time.Now().Add(t.writeTimeout))
+	if err != nil {
+		return err
+	}
+	payloadType := t.ws.PayloadType
+	defer func() {
+		t.ws.PayloadType = payloadType
+	}()
+	t.ws.PayloadType = websocket.PingFrame
+	_, err = t.ws.Write(nil)
+	return err
+}
+
+// read handles the client's messages, every message including
+// the heartbeat postpones the idle timeout. The legacy messages are
+// discarded.
+func (ss *session) read() {
+	defer close(ss.closed)
+	var msg []byte
+	for {
+		err := ss.ws.SetReadDeadline(time.Now().Add(ss.s.cfg.Websocket.IdleTimeout))
+		if err != nil {
+			return
+		}
+		err = websocket.Message.Receive(ss.ws, &msg)
+		if err != nil {
+			return
+		}
+		if ss.v1 {
+			ss.command(msg)
+		}
+	}
+}
+
+// command runs the client's command and replies to it when it has
+// an id, the errors are always reported.
+func (ss *session) command(msg []byte) {
+	f := new(Frame)
+	err := json.Unmarshal(msg, f)
+	if err != nil {
+		ss.reply(f, FrameError, ErrorPayload{Message: "invalid frame: " + err.Error()})
+		return
+	}
+	var typ string
+	var payload interface{}
+	switch f.Type {
+	case FrameHeartbeat:
+		return
+	case FrameAck:
+		err = ss.ack(f)
+	case FrameSubscribe:
+		err = ss.subscribe(f)
+	case FramePage:
+		typ = FramePage
+		payload, err = ss.page(f)
+	case FramePresence:
+		err = ss.presence(f)
+	default:
+		err = fmt.Errorf("unknown frame type %q", f.Type)
+	}
+	if err != nil {
+		ss.reply(f, FrameError, ErrorPayload{Message: err.Error()})
+		return
+	}
+	if f.Id == "" {
+		return
+	}
+	if typ == "" {
+		typ = FrameOk
+	}
+	ss.reply(f, typ, payload)
+}
+
+func (ss *session) reply(f *Frame, typ string, payload interface{}) {
+	reply := Frame{Type: typ, Id: f.Id}
+	if payload != nil {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			ss.c.Logger().Error(err)
+			return
+		}
+		reply.Payload = body
+	}
+	select {
+	case ss.replies <- reply:
+	case <-ss.done:
+	}
+}
+
+// ack saves the last shown publication, the next v1 websocket without
+// since resumes from it.
+func (ss *session) ack(f *Frame) error {
+	ack := new(Ack)
+	err := decodePayload(f, ack)
+	if err != nil || ack.Id <= ss.acked {
+		return err
+	}
+	ss.acked = ack.Id
+	return ss.s.cache.SetCheckpoint(ss.s.ctx, seenCheckpoint(ss.userId), ack.Id)
+}
+
+func (ss *session) subscribe(f *Frame) error {
+	sub := new(Subscription)
+	err := decodePayload(f, sub)
+	if err != nil {
+		return err
+	}
+	topics, err := sub.topics()
+	if err != nil {
+		return err
+	}
+	err = ss.s.checkPresence(ss.s.ctx, ss.userId, sub.Presence)
+	if err != nil {
+		return err
+	}
+	return ss.s.hub.extend(ss.s.ctx, ss.conn, topics)
+}
+
+func (ss *session) page(f *Frame) (*FeedPage, error) {
+	req := &PageRequest{Limit: ss.s.cfg.Feed.PageSize}
+	if len(f.Payload) > 0 {
+		err := decodePayload(f, req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if req.Limit <= 0 || req.Limit > ss.s.cfg.Feed.MaxPageSize {
+		return nil, fmt.Errorf("limit should be between 1 and %d",
+			ss.s.cfg.Feed.MaxPageSize)
+	}
+	var cursor Cursor
+	if req.Cursor != "" {
+		var err error
+		cursor, err = ParseCursor(req.Cursor)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := ss.s.EnsureFeed(ss.s.ctx, ss.userId)
+	if err != nil {
+		return nil, err
+	}
+	return ss.s.feedPage(ss.s.ctx, ss.userId, cursor, req.Limit)
+}
+
+// presence tells the users following the presence of the user
+// about its status.
+func (ss *session) presence(f *Frame) error {
+	p := new(Presence)
+	err := decodePayload(f, p)
+	if err != nil {
+		return err
+	}
+	if !presenceStatuses[p.Status] {
+		return fmt.Errorf("unknown presence status %q", p.Status)
+	}
+	p.UserId = ss.userId
+	body, err := newFrame(FramePresence, p)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ss.s.ctx, ss.s.cfg.Timeouts.Publish)
+	defer cancel()
+	return ss.s.broker.PublishTopic(ctx, presenceTopic(ss.userId), body)
+}
@@ -0,0 +1,3 @@
+ALTER TABLE users
+    ADD COLUMN password CHAR(60) NOT NULL DEFAULT '',
+    ADD UNIQUE (login);
@@ -1,5 +1,13 @@
 var loc = window.location;
 var userIdRegEx = new RegExp('userId=([0-9]+)');
+// token is the access token of the user
+var token = new URLSearchParams(loc.search).get('token');
+var topicParams = ['authors', 'hashtags', 'announcements'];
+// the server closes a websocket silent for -websocket-idle-timeout
+var heartbeatInterval = 20000;
+var reconnectDelay = 1000;
+// lastId resumes the feed after reconnecting
+var lastId = 0;
 
 window.onload = async () => {
     if (!userIdRegEx?.test(loc.search)) {
@@ -8,10 +16,11 @@ window.onload = async () => {
         var userId = userIdRegEx.exec(loc.search)[1];
 
         var response = await fetch(
-            '//' + loc.hostname + ':1234/feed/' + userId);
+            '//' + loc.hostname + ':1234/feed/' + userId,
+            {headers: {'Authorization': 'Bearer ' + token}});
         var publications = await response.json();
         for (var publication of publications.reverse()) {
-            addTableRow(publication);
+            addPublication(publication);
         }
 
         var uri = 'ws:';
@@ -21,22 +30,62 @@ window.onload = async () => {
         }
         uri += '//' + loc.hostname + ':1234';
         uri += '/'+ userId + '/ws';
-        
-        ws = new WebSocket(uri)
-        
-        ws.onopen = () => console.log('WS Connected');
-        
-        ws.onmessage = async (evt) => addTableRow(
-            JSON.parse(await evt.data.text())
-        );
+
+        connect(uri);
     }
 };
 
+function connect(uri) {
+    var query = topicQuery();
+    // the browser can't set the header of a websocket
+    query.set('token', token);
+    if (lastId > 0) {
+        query.set('since', lastId);
+    }
+    var search = query.toString();
+    var ws = new WebSocket(search ? uri + '?' + search : uri);
+    var heartbeat;
+
+    ws.onopen = () => {
+        console.log('WS Connected');
+        heartbeat = setInterval(() => ws.send('heartbeat'), heartbeatInterval);
+    };
+
+    ws.onclose = () => {
+        clearInterval(heartbeat);
+        setTimeout(() => connect(uri), reconnectDelay);
+    };
+
+    ws.onmessage = async (evt) => addPublication(
+        JSON.parse(await evt.data.text())
+    );
+}
+
+// topicQuery passes the subscriptions of the page to the websocket.
+function topicQuery() {
+    var params = new URLSearchParams(loc.search);
+    var query = new URLSearchParams();
+    for (var name of topicParams) {
+        if (params.has(name)) {
+            query.set(name, params.get(name));
+        }
+    }
+    return query;
+}
+
+function addPublication(data) {
+    if (data['id'] > lastId) {
+        lastId = data['id'];
+    }
+    addTableRow(data);
+}
+
 function addTableRow(data) {
     var theader = document.getElementById('tableHeader');
     var tr = document.createElement('tr');
     var author = document.createElement('td');
-    author.textContent = data['author'];
+    // announcements have no author
+    author.textContent = data['author'] ?? 'system';
     var text = document.createElement('td');
     text.textContent = data['text'];
     var time = document.createElement('td');